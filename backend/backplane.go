@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Postgres channel hub events are sent on
+const backplaneChannel = "docsy_hub"
+
+// NOTIFY payloads must stay under 8000 bytes; larger events are stored in
+// hub_events and the notification carries a reference
+const maxNotifyPayload = 7000
+
+// How long spilled events are kept for other instances to read
+const spilledEventTTL = 5 * time.Minute
+
+// Backplane fans room events out to the hub of every backend instance,
+// including the one that published them
+type Backplane interface {
+	Publish(ctx context.Context, event DocumentEvent) error
+	// Deliver received events to handler until ctx is cancelled
+	Start(ctx context.Context, handler func(DocumentEvent)) error
+	Close() error
+}
+
+// Sequencer is implemented by backplanes that hand out conversation sequence
+// numbers from a counter shared by every instance
+type Sequencer interface {
+	NextSeq(ctx context.Context, key string) (int64, error)
+}
+
+// How long a shared sequence counter is kept after its last use. A counter
+// that is dropped restarts from the clock, which is past its last value.
+const sequenceRetention = 24 * time.Hour
+
+// Create a backplane by name: "memory" (default, single instance) or
+// "postgres" (LISTEN/NOTIFY on the application database)
+func newBackplane(name string) (Backplane, error) {
+	switch strings.ToLower(name) {
+	case "", "memory":
+		return &MemoryBackplane{}, nil
+	case "postgres":
+		return &PostgresBackplane{}, nil
+	default:
+		return nil, fmt.Errorf("unknown hub backplane %q", name)
+	}
+}
+
+// MemoryBackplane delivers events within this process
+type MemoryBackplane struct {
+	handler func(DocumentEvent)
+}
+
+func (b *MemoryBackplane) Publish(ctx context.Context, event DocumentEvent) error {
+	b.handler(event)
+	return nil
+}
+
+func (b *MemoryBackplane) Start(ctx context.Context, handler func(DocumentEvent)) error {
+	b.handler = handler
+	return nil
+}
+
+func (b *MemoryBackplane) Close() error {
+	return nil
+}
+
+// PostgresBackplane sends events through Postgres LISTEN/NOTIFY so that
+// every instance connected to the same database receives them. It also
+// hands out conversation sequence numbers from conversation_sequences.
+type PostgresBackplane struct {
+	listener *pq.Listener
+}
+
+// Notification payload: the event itself, or a reference to a spilled event
+type backplaneMessage struct {
+	Event *DocumentEvent `json:"event,omitempty"`
+	Ref   string         `json:"ref,omitempty"`
+}
+
+func (b *PostgresBackplane) Publish(ctx context.Context, event DocumentEvent) error {
+	payload, err := json.Marshal(backplaneMessage{Event: &event})
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %v", err)
+	}
+
+	if len(payload) > maxNotifyPayload {
+		ref := uuid.New().String()
+		eventJSON, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("failed to encode event: %v", err)
+		}
+		if _, err := db.ExecContext(ctx, "INSERT INTO hub_events (id, payload) VALUES ($1, $2)", ref, string(eventJSON)); err != nil {
+			return fmt.Errorf("failed to store event: %v", err)
+		}
+		if _, err := db.ExecContext(ctx, "DELETE FROM hub_events WHERE created_at < $1", time.Now().Add(-spilledEventTTL)); err != nil {
+			log.Printf("Error deleting old hub events: %v", err)
+		}
+
+		payload, _ = json.Marshal(backplaneMessage{Ref: ref})
+	}
+
+	if _, err := db.ExecContext(ctx, "SELECT pg_notify($1, $2)", backplaneChannel, string(payload)); err != nil {
+		return fmt.Errorf("failed to notify: %v", err)
+	}
+	return nil
+}
+
+// Next sequence number for a conversation: one past the last one handed out,
+// or the database clock in microseconds if that is larger. The database
+// clock is shared by every instance.
+func (b *PostgresBackplane) NextSeq(ctx context.Context, key string) (int64, error) {
+	var seq int64
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO conversation_sequences (conversation, last, updated_at)
+		VALUES ($1, (extract(epoch FROM clock_timestamp()) * 1000000)::bigint, now())
+		ON CONFLICT (conversation) DO UPDATE
+		SET last = GREATEST(conversation_sequences.last + 1, EXCLUDED.last), updated_at = now()
+		RETURNING last`, key).Scan(&seq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get sequence number: %v", err)
+	}
+	return seq, nil
+}
+
+// Delete sequence counters that haven't been used for a while
+func (b *PostgresBackplane) pruneSequences(ctx context.Context) {
+	_, err := db.ExecContext(ctx, "DELETE FROM conversation_sequences WHERE updated_at < $1", time.Now().Add(-sequenceRetention))
+	if err != nil {
+		log.Printf("Error deleting old sequence counters: %v", err)
+	}
+}
+
+func (b *PostgresBackplane) Start(ctx context.Context, handler func(DocumentEvent)) error {
+	b.listener = pq.NewListener(cfg.DatabaseURL, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Hub backplane listener error: %v", err)
+		}
+	})
+	if err := b.listener.Listen(backplaneChannel); err != nil {
+		b.listener.Close()
+		return fmt.Errorf("failed to listen on %s: %v", backplaneChannel, err)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case notification, ok := <-b.listener.Notify:
+				if !ok {
+					return
+				}
+				// A nil notification means the connection was re-established;
+				// events sent while it was down are lost
+				if notification == nil {
+					log.Printf("Hub backplane reconnected")
+					continue
+				}
+				if event, err := b.decode(ctx, notification.Extra); err != nil {
+					log.Printf("Error reading hub event: %v", err)
+				} else {
+					handler(*event)
+				}
+
+			case <-time.After(90 * time.Second):
+				go b.listener.Ping()
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				b.pruneSequences(ctx)
+			}
+		}
+	}()
+
+	log.Printf("Hub backplane listening on Postgres channel %s", backplaneChannel)
+	return nil
+}
+
+// Decode a notification, loading the event from hub_events if it was spilled
+func (b *PostgresBackplane) decode(ctx context.Context, payload string) (*DocumentEvent, error) {
+	var msg backplaneMessage
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		return nil, fmt.Errorf("failed to decode notification: %v", err)
+	}
+	if msg.Event != nil {
+		return msg.Event, nil
+	}
+
+	var eventJSON string
+	if err := db.QueryRowContext(ctx, "SELECT payload FROM hub_events WHERE id = $1", msg.Ref).Scan(&eventJSON); err != nil {
+		return nil, fmt.Errorf("failed to load event %s: %v", msg.Ref, err)
+	}
+
+	var event DocumentEvent
+	if err := json.Unmarshal([]byte(eventJSON), &event); err != nil {
+		return nil, fmt.Errorf("failed to decode event %s: %v", msg.Ref, err)
+	}
+	return &event, nil
+}
+
+func (b *PostgresBackplane) Close() error {
+	if b.listener == nil {
+		return nil
+	}
+	return b.listener.Close()
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Batch statuses
+const (
+	batchRunning   = "running"
+	batchCompleted = "completed"
+)
+
+// Batch items are only queued in memory, so the instance running a batch
+// marks it alive every batchHeartbeatInterval. Running batches not marked
+// within batchHeartbeatTimeout lost their instance, and are taken over by
+// whichever instance notices first. An instance shutting down releases its
+// unfinished batches so they are taken over without waiting for the timeout.
+const (
+	batchHeartbeatInterval = time.Minute
+	batchHeartbeatTimeout  = 3 * time.Minute
+)
+
+// ExtractionBatch applies one schema to every document in a collection
+type ExtractionBatch struct {
+	ID          string          `json:"id"`
+	UserID      string          `json:"user_id"`
+	Collection  string          `json:"collection"`
+	Schema      json.RawMessage `json:"schema"`
+	Status      string          `json:"status"`
+	Total       int             `json:"total"`
+	Succeeded   int             `json:"succeeded"`
+	Failed      int             `json:"failed"`
+	CreatedAt   time.Time       `json:"created_at"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+}
+
+// BatchItem is the outcome of a batch for one document
+type BatchItem struct {
+	DocumentID    string               `json:"document_id"`
+	FileName      string               `json:"file_name"`
+	Status        string               `json:"status"`
+	ExtractionID  string               `json:"extraction_id,omitempty"`
+	Error         string               `json:"error,omitempty"`
+	DroppedChunks int                  `json:"dropped_chunks"`
+	Result        json.RawMessage      `json:"result,omitempty"`
+	Citations     []ExtractionCitation `json:"citations,omitempty"`
+}
+
+type BatchExtractRequest struct {
+	Schema json.RawMessage `json:"schema" binding:"required"`
+	UserID string          `json:"user_id" binding:"required"`
+}
+
+// Extract one document of a batch and record the outcome. An item cut off
+// by shutdown is left without an outcome for the next instance to run.
+func runBatchItem(ctx context.Context, batchID, documentID, userID string, schema map[string]interface{}) {
+	run, err := runExtraction(ctx, documentID, schema)
+	if ctx.Err() != nil {
+		releaseBatch(batchID)
+		return
+	}
+	if err != nil {
+		run = failedExtractionRun(documentID, schema, err.Error())
+	}
+	recordBatchItem(ctx, batchID, userID, run)
+}
+
+// Record a batch item that can never be run, e.g. because the batch's
+// schema is invalid, as failed
+func failBatchItem(batchID, documentID, userID string, reason string) {
+	recordBatchItem(context.Background(), batchID, userID, failedExtractionRun(documentID, nil, reason))
+}
+
+// Hand a batch this instance won't finish, because it is shutting down, to
+// the next instance that looks for abandoned batches
+func releaseBatch(batchID string) {
+	_, err := db.Exec(`
+		UPDATE extraction_batches SET instance_id = NULL, heartbeat_at = NULL
+		WHERE id = $1 AND instance_id = $2 AND status = $3`, batchID, instanceID, batchRunning)
+	if err != nil {
+		log.Printf("Error releasing batch %s: %v", batchID, err)
+	}
+}
+
+// A failed extraction run with the given error
+func failedExtractionRun(documentID string, schema map[string]interface{}, reason string) *ExtractionRun {
+	schemaJSON, _ := json.Marshal(schema)
+	return &ExtractionRun{
+		ID:         uuid.New().String(),
+		DocumentID: documentID,
+		Schema:     schemaJSON,
+		Status:     extractionFailed,
+		Error:      reason,
+		CreatedAt:  time.Now(),
+	}
+}
+
+// Save a batch item's extraction run and count it towards the batch. An
+// item can be run twice, by an instance that missed its heartbeats and the
+// instance that took the batch over; only the first outcome counts.
+func recordBatchItem(ctx context.Context, batchID, userID string, run *ExtractionRun) {
+	run.UserID = userID
+	run.BatchID = batchID
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("Error saving extraction for batch %s: %v", batchID, err)
+		return
+	}
+	defer tx.Rollback()
+
+	saved, err := saveExtractionRun(ctx, tx, run)
+	if err != nil {
+		log.Printf("Error saving extraction for batch %s: %v", batchID, err)
+		return
+	}
+	if !saved {
+		log.Printf("Batch %s already has an outcome for document %s", batchID, run.DocumentID)
+		return
+	}
+
+	counter := "failed"
+	if run.Status == extractionSucceeded {
+		counter = "succeeded"
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`
+		UPDATE extraction_batches
+		SET %[1]s = %[1]s + 1,
+			status = CASE WHEN succeeded + failed + 1 >= total THEN '%[2]s' ELSE status END,
+			completed_at = CASE WHEN succeeded + failed + 1 >= total THEN NOW() ELSE completed_at END
+		WHERE id = $1`, counter, batchCompleted), batchID)
+	if err != nil {
+		log.Printf("Error updating batch %s: %v", batchID, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error saving extraction for batch %s: %v", batchID, err)
+	}
+}
+
+// Jobs extracting a batch's documents
+func batchJobs(batchID, userID string, documentIDs []string, schema map[string]interface{}) []Job {
+	jobs := make([]Job, 0, len(documentIDs))
+	for _, documentID := range documentIDs {
+		documentID := documentID
+		jobs = append(jobs, Job{
+			Name: "extract " + documentID,
+			Run: func(ctx context.Context) {
+				runBatchItem(ctx, batchID, documentID, userID, schema)
+			},
+			// Left without an outcome, so the next instance runs it
+			Abandon: func(reason string) {
+				releaseBatch(batchID)
+			},
+		})
+	}
+	return jobs
+}
+
+// Keep this instance's running batches alive and take over the batches of
+// instances that stopped without finishing them, including this instance's
+// previous run. Runs until ctx is cancelled.
+func superviseBatches(ctx context.Context) {
+	ticker := time.NewTicker(batchHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		if !draining.Load() {
+			heartbeatBatches(ctx)
+			claimAbandonedBatches(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Mark this instance's running batches alive
+func heartbeatBatches(ctx context.Context) {
+	_, err := db.ExecContext(ctx, `
+		UPDATE extraction_batches SET heartbeat_at = NOW()
+		WHERE instance_id = $1 AND status = $2`, instanceID, batchRunning)
+	if err != nil {
+		log.Printf("Error marking batches alive: %v", err)
+	}
+}
+
+// Take over running batches whose instance stopped marking them alive and
+// queue their unprocessed documents. Items that were running when the
+// instance stopped have no saved outcome, so they're run again.
+func claimAbandonedBatches(ctx context.Context) {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE extraction_batches SET instance_id = $1, heartbeat_at = NOW()
+		WHERE status = $2 AND (heartbeat_at IS NULL OR heartbeat_at < NOW() - make_interval(secs => $3))
+		RETURNING id`, instanceID, batchRunning, batchHeartbeatTimeout.Seconds())
+	if err != nil {
+		log.Printf("Error claiming abandoned batches: %v", err)
+		return
+	}
+
+	var batchIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Error scanning batch: %v", err)
+			continue
+		}
+		batchIDs = append(batchIDs, id)
+	}
+	rows.Close()
+
+	for _, batchID := range batchIDs {
+		if err := resumeBatch(ctx, batchID); err != nil {
+			log.Printf("Error resuming batch %s: %v", batchID, err)
+		}
+	}
+}
+
+// Queue the documents of a batch that have no outcome yet, completing the
+// batch if there are none
+func resumeBatch(ctx context.Context, batchID string) error {
+	batch, err := getBatch(ctx, batchID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch batch: %v", err)
+	}
+
+	items, err := getBatchItems(ctx, batch)
+	if err != nil {
+		return err
+	}
+
+	var pending []string
+	for _, item := range items {
+		if item.Status == "pending" {
+			pending = append(pending, item.DocumentID)
+		}
+	}
+
+	if len(pending) == 0 {
+		// Documents deleted before they were processed never count towards total
+		_, err := db.ExecContext(ctx, `
+			UPDATE extraction_batches SET status = $1, completed_at = NOW()
+			WHERE id = $2 AND status = $3`, batchCompleted, batchID, batchRunning)
+		if err != nil {
+			return fmt.Errorf("failed to complete batch: %v", err)
+		}
+		return nil
+	}
+
+	schema, err := parseExtractionSchema(batch.Schema)
+	if err != nil {
+		for _, documentID := range pending {
+			failBatchItem(batchID, documentID, batch.UserID, "invalid schema: "+err.Error())
+		}
+		return nil
+	}
+
+	log.Printf("Resuming batch %s with %d unprocessed documents", batchID, len(pending))
+	worker.EnqueueAll(batchJobs(batchID, batch.UserID, pending, schema))
+	return nil
+}
+
+// Start a batch extraction over every document in a collection
+func batchExtractHandler(c *gin.Context) {
+	collection := c.Param("collection")
+
+	var req BatchExtractRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	schema, err := parseExtractionSchema(req.Schema)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "Invalid schema: " + err.Error(),
+		})
+		return
+	}
+
+	rows, err := db.Query("SELECT id FROM documents WHERE user_id = $1 AND collection = $2 ORDER BY uploaded_at", req.UserID, collection)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to fetch documents: " + err.Error(),
+		})
+		return
+	}
+
+	var documentIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Error scanning document: %v", err)
+			continue
+		}
+		documentIDs = append(documentIDs, id)
+	}
+	rows.Close()
+
+	if len(documentIDs) == 0 {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Success: false,
+			Error:   "No documents found in this collection",
+		})
+		return
+	}
+
+	batch := ExtractionBatch{
+		ID:         uuid.New().String(),
+		UserID:     req.UserID,
+		Collection: collection,
+		Schema:     req.Schema,
+		Status:     batchRunning,
+		Total:      len(documentIDs),
+		CreatedAt:  time.Now(),
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO extraction_batches (id, user_id, collection, schema, status, total, created_at, instance_id, heartbeat_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW())`,
+		batch.ID, batch.UserID, batch.Collection, string(batch.Schema), batch.Status, batch.Total, batch.CreatedAt, instanceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to create batch: " + err.Error(),
+		})
+		return
+	}
+
+	// A large collection doesn't hold the request while the worker queue is full
+	worker.EnqueueAll(batchJobs(batch.ID, batch.UserID, documentIDs, schema))
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"success": true,
+		"batch":   batch,
+	})
+}
+
+// Fetch a batch's progress
+func getBatch(ctx context.Context, batchID string) (*ExtractionBatch, error) {
+	var batch ExtractionBatch
+	var schema string
+	var completedAt sql.NullTime
+	err := db.QueryRowContext(ctx, `
+		SELECT id, user_id, collection, schema, status, total, succeeded, failed, created_at, completed_at
+		FROM extraction_batches WHERE id = $1`, batchID).
+		Scan(&batch.ID, &batch.UserID, &batch.Collection, &schema, &batch.Status, &batch.Total,
+			&batch.Succeeded, &batch.Failed, &batch.CreatedAt, &completedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	batch.Schema = json.RawMessage(schema)
+	if completedAt.Valid {
+		batch.CompletedAt = &completedAt.Time
+	}
+	return &batch, nil
+}
+
+// Fetch the per-document outcomes of a batch. Documents not yet processed
+// are reported as pending.
+func getBatchItems(ctx context.Context, batch *ExtractionBatch) ([]BatchItem, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT d.id, d.file_name, COALESCE(r.status, 'pending'), COALESCE(r.id, ''), COALESCE(r.error, ''), COALESCE(r.dropped_chunks, 0), r.result, COALESCE(r.citations, '[]')
+		FROM documents d
+		LEFT JOIN extraction_runs r ON r.document_id = d.id AND r.batch_id = $1
+		WHERE d.user_id = $2 AND d.collection = $3 AND d.uploaded_at <= $4
+		ORDER BY d.uploaded_at`, batch.ID, batch.UserID, batch.Collection, batch.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch batch items: %v", err)
+	}
+	defer rows.Close()
+
+	var items []BatchItem
+	for rows.Next() {
+		var item BatchItem
+		var result sql.NullString
+		var citations string
+		err := rows.Scan(&item.DocumentID, &item.FileName, &item.Status, &item.ExtractionID, &item.Error, &item.DroppedChunks, &result, &citations)
+		if err != nil {
+			log.Printf("Error scanning batch item: %v", err)
+			continue
+		}
+		if result.Valid {
+			item.Result = json.RawMessage(result.String)
+		}
+		if err := json.Unmarshal([]byte(citations), &item.Citations); err != nil {
+			log.Printf("Error decoding citations for batch item: %v", err)
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// Load a batch and its items for a handler, writing the error response on failure
+func loadBatchForRequest(c *gin.Context) (*ExtractionBatch, []BatchItem, bool) {
+	batch, err := getBatch(c.Request.Context(), c.Param("batchId"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Success: false,
+			Error:   "Batch not found",
+		})
+		return nil, nil, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to fetch batch: " + err.Error(),
+		})
+		return nil, nil, false
+	}
+
+	items, err := getBatchItems(c.Request.Context(), batch)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return nil, nil, false
+	}
+
+	return batch, items, true
+}
+
+// Batch status endpoint
+func getBatchHandler(c *gin.Context) {
+	batch, items, ok := loadBatchForRequest(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"batch":   batch,
+		"items":   items,
+	})
+}
+
+// Export batch results as CSV (one column per top-level schema property) or
+// newline-delimited JSON (one object per document)
+func exportBatchHandler(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "ndjson" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "format must be csv or ndjson",
+		})
+		return
+	}
+
+	batch, items, ok := loadBatchForRequest(c)
+	if !ok {
+		return
+	}
+
+	filename := fmt.Sprintf("batch-%s.%s", batch.ID, format)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	if format == "ndjson" {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		encoder := json.NewEncoder(c.Writer)
+		for _, item := range items {
+			if err := encoder.Encode(item); err != nil {
+				log.Printf("Error writing batch export: %v", err)
+				return
+			}
+		}
+		return
+	}
+
+	var schema map[string]interface{}
+	json.Unmarshal(batch.Schema, &schema)
+	properties, _ := schema["properties"].(map[string]interface{})
+	fields := make([]string, 0, len(properties))
+	for name := range properties {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+
+	c.Header("Content-Type", "text/csv")
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	w.Write(append([]string{"document_id", "file_name", "status", "error", "dropped_chunks"}, fields...))
+
+	for _, item := range items {
+		var data map[string]interface{}
+		if len(item.Result) > 0 {
+			json.Unmarshal(item.Result, &data)
+		}
+
+		record := []string{item.DocumentID, item.FileName, item.Status, item.Error, strconv.Itoa(item.DroppedChunks)}
+		for _, field := range fields {
+			record = append(record, csvValue(data[field]))
+		}
+		w.Write(record)
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Printf("Error writing batch export: %v", err)
+	}
+}
+
+// Format a JSON value for a CSV cell: scalars as text, objects and arrays as JSON
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the server, loaded once at startup.
+// Sources, lowest precedence first: defaults, the YAML file named by
+// -config or CONFIG_FILE, environment variables, then command-line flags.
+type Config struct {
+	Port            string        `yaml:"port"`
+	FrontendURL     string        `yaml:"frontend_url"`
+	AllowedOrigins  []string      `yaml:"allowed_origins"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	DatabaseURL string `yaml:"database_url"`
+
+	LLMProvider      string        `yaml:"llm_provider"`
+	APIKey           string        `yaml:"api_key"`
+	LLMModel         string        `yaml:"llm_model"`
+	LLMTimeout       time.Duration `yaml:"llm_timeout"`
+	MaxContextTokens int           `yaml:"max_context_tokens"`
+	Tokenizer        string        `yaml:"tokenizer"`
+
+	ChunkSize         int    `yaml:"chunk_size"`
+	AutoSuggest       bool   `yaml:"auto_suggest"`
+	AutoSummarize     bool   `yaml:"auto_summarize"`
+	PromptTemplateDir string `yaml:"prompt_template_dir"`
+
+	QueryRewrite            bool    `yaml:"query_rewrite"`
+	QueryExpansion          bool    `yaml:"query_expansion"`
+	Reranker                string  `yaml:"reranker"`
+	RetrievalVectorWeight   float64 `yaml:"retrieval_vector_weight"`
+	RetrievalKeywordWeight  float64 `yaml:"retrieval_keyword_weight"`
+	RetrievalRRFK           float64 `yaml:"retrieval_rrf_k"`
+	RetrievalDebug          bool    `yaml:"retrieval_debug"`
+	PersistCancelledAnswers bool    `yaml:"persist_cancelled_answers"`
+
+	HubBackplane      string `yaml:"hub_backplane"`
+	WorkerConcurrency int    `yaml:"worker_concurrency"`
+}
+
+// Configuration in effect, loaded in main
+var cfg = defaultConfig()
+
+// Settings used when no source sets them
+func defaultConfig() *Config {
+	return &Config{
+		Port:                   "8080",
+		ShutdownTimeout:        25 * time.Second,
+		LLMProvider:            "gemini",
+		LLMModel:               "gemini-2.5-flash",
+		LLMTimeout:             2 * time.Minute,
+		Tokenizer:              "estimate",
+		ChunkSize:              1000,
+		AutoSuggest:            true,
+		RetrievalVectorWeight:  1,
+		RetrievalKeywordWeight: 1,
+		RetrievalRRFK:          60,
+		HubBackplane:           "memory",
+		WorkerConcurrency:      4,
+	}
+}
+
+// A setting that can come from the environment or a flag. The flag name is
+// the YAML key with dashes; the first environment variable set wins.
+type setting struct {
+	key   string
+	env   []string
+	usage string
+	value interface{}
+}
+
+// Every setting, pointing into c
+func (c *Config) settings() []setting {
+	return []setting{
+		{"port", []string{"PORT"}, "HTTP port to listen on", &c.Port},
+		{"frontend_url", []string{"FRONTEND_URL"}, "URL of the frontend, allowed as an origin when allowed_origins is empty", &c.FrontendURL},
+		{"allowed_origins", []string{"ALLOWED_ORIGINS"}, "comma-separated browser origins allowed by CORS and WebSockets; * matches within one host label", &c.AllowedOrigins},
+		{"shutdown_timeout", []string{"SHUTDOWN_TIMEOUT"}, "time allowed for in-flight work to finish on shutdown", &c.ShutdownTimeout},
+		{"database_url", []string{"DATABASE_URL", "DB_URL"}, "PostgreSQL connection string", &c.DatabaseURL},
+		{"llm_provider", []string{"LLM_PROVIDER"}, "LLM provider: gemini or fake", &c.LLMProvider},
+		{"api_key", []string{"API_KEY"}, "Gemini API key", &c.APIKey},
+		{"llm_model", []string{"LLM_MODEL"}, "Gemini model used for answers and pipeline steps", &c.LLMModel},
+		{"llm_timeout", []string{"LLM_TIMEOUT"}, "timeout of a single Gemini API call, including streaming", &c.LLMTimeout},
+		{"max_context_tokens", []string{"MAX_CONTEXT_TOKENS"}, "cap on document context tokens per prompt; 0 uses the model's default", &c.MaxContextTokens},
+		{"tokenizer", []string{"TOKENIZER"}, "token counter: estimate or gemini", &c.Tokenizer},
+		{"chunk_size", []string{"CHUNK_SIZE"}, "maximum characters per chunk at ingestion", &c.ChunkSize},
+		{"auto_suggest", []string{"AUTO_SUGGEST"}, "generate suggested questions after upload", &c.AutoSuggest},
+		{"auto_summarize", []string{"AUTO_SUMMARIZE"}, "summarise documents after upload", &c.AutoSummarize},
+		{"prompt_template_dir", []string{"PROMPT_TEMPLATE_DIR"}, "directory of extra or overriding prompt templates", &c.PromptTemplateDir},
+		{"query_rewrite", []string{"QUERY_REWRITE"}, "rewrite follow-up questions by default", &c.QueryRewrite},
+		{"query_expansion", []string{"QUERY_EXPANSION"}, "expand queries into several searches by default", &c.QueryExpansion},
+		{"reranker", []string{"RERANKER"}, "second-stage reranker: llm, lexical or empty for none", &c.Reranker},
+		{"retrieval_vector_weight", []string{"RETRIEVAL_VECTOR_WEIGHT"}, "fusion weight of the vector ranking", &c.RetrievalVectorWeight},
+		{"retrieval_keyword_weight", []string{"RETRIEVAL_KEYWORD_WEIGHT"}, "fusion weight of the keyword ranking", &c.RetrievalKeywordWeight},
+		{"retrieval_rrf_k", []string{"RETRIEVAL_RRF_K"}, "reciprocal rank fusion constant", &c.RetrievalRRFK},
+		{"retrieval_debug", []string{"RETRIEVAL_DEBUG"}, "log per-chunk retrieval scores", &c.RetrievalDebug},
+		{"persist_cancelled_answers", []string{"PERSIST_CANCELLED_ANSWERS"}, "save partial answers of cancelled queries", &c.PersistCancelledAnswers},
+		{"hub_backplane", []string{"HUB_BACKPLANE"}, "WebSocket hub backplane: memory or postgres", &c.HubBackplane},
+		{"worker_concurrency", []string{"WORKER_CONCURRENCY"}, "number of background jobs run at once", &c.WorkerConcurrency},
+	}
+}
+
+// Parse a string into a setting's field
+func (s setting) set(raw string) error {
+	raw = strings.TrimSpace(raw)
+	switch v := s.value.(type) {
+	case *string:
+		*v = raw
+	case *int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%s must be an integer, got %q", s.key, raw)
+		}
+		*v = n
+	case *float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, got %q", s.key, raw)
+		}
+		*v = f
+	case *bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false, got %q", s.key, raw)
+		}
+		*v = b
+	case *time.Duration:
+		// A bare number is a count of seconds
+		if n, err := strconv.Atoi(raw); err == nil {
+			*v = time.Duration(n) * time.Second
+			return nil
+		}
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration such as 30s, got %q", s.key, raw)
+		}
+		*v = d
+	case *[]string:
+		*v = nil
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*v = append(*v, item)
+			}
+		}
+	default:
+		return fmt.Errorf("%s has an unsupported type", s.key)
+	}
+	return nil
+}
+
+// Load the configuration from its sources. args are command-line flags; a
+// -config flag or CONFIG_FILE names the YAML file. The result is not
+// validated.
+func loadConfig(name string, args []string) (*Config, error) {
+	c := defaultConfig()
+	settings := c.settings()
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+	byFlag := make(map[string]setting)
+	for _, s := range settings {
+		flagName := strings.ReplaceAll(s.key, "_", "-")
+		flags.String(flagName, "", s.usage+" (env "+s.env[0]+")")
+		byFlag[flagName] = s
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	if *configPath != "" {
+		if err := c.loadYAML(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		for _, key := range s.env {
+			if value := os.Getenv(key); value != "" {
+				if err := s.set(value); err != nil {
+					return nil, fmt.Errorf("invalid %s: %v", key, err)
+				}
+				break
+			}
+		}
+	}
+
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		if s, ok := byFlag[f.Name]; ok && flagErr == nil {
+			if err := s.set(f.Value.String()); err != nil {
+				flagErr = fmt.Errorf("invalid -%s: %v", f.Name, err)
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	return c, nil
+}
+
+// Read settings from a YAML file. Unknown keys are errors, so typos don't
+// go unnoticed. Durations are parsed like environment variables and flags,
+// so a bare number is a count of seconds.
+func (c *Config) loadYAML(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %v", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("failed to parse config file %s: line %d: expected a mapping of settings", path, root.Line)
+	}
+
+	settings := make(map[string]setting)
+	for _, s := range c.settings() {
+		settings[s.key] = s
+	}
+
+	// Durations are set here and left out of the decode, which would reject
+	// bare numbers
+	var rest []*yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		s, ok := settings[key.Value]
+		if !ok {
+			return fmt.Errorf("failed to parse config file %s: line %d: unknown setting %q", path, key.Line, key.Value)
+		}
+		if _, ok := s.value.(*time.Duration); ok && value.Kind == yaml.ScalarNode {
+			if err := s.set(value.Value); err != nil {
+				return fmt.Errorf("failed to parse config file %s: line %d: %v", path, value.Line, err)
+			}
+			continue
+		}
+		rest = append(rest, key, value)
+	}
+	root.Content = rest
+
+	if err := root.Decode(c); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// Check the configuration, reporting every problem at once
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	oneOf := func(value string, allowed ...string) bool {
+		for _, a := range allowed {
+			if strings.EqualFold(value, a) {
+				return true
+			}
+		}
+		return false
+	}
+
+	port, err := strconv.Atoi(c.Port)
+	check(err == nil && port > 0 && port < 65536, "port must be a number between 1 and 65535, got %q", c.Port)
+	check(c.ShutdownTimeout > 0, "shutdown_timeout must be positive")
+	for _, origin := range c.AllowedOrigins {
+		check(strings.Contains(origin, "://"), "allowed_origins entry %q must include a scheme, e.g. https://", origin)
+	}
+
+	check(c.DatabaseURL != "", "database_url is required (DATABASE_URL or DB_URL)")
+
+	check(oneOf(c.LLMProvider, "gemini", "fake"), "llm_provider must be gemini or fake, got %q", c.LLMProvider)
+	if strings.EqualFold(c.LLMProvider, "gemini") {
+		check(c.APIKey != "", "api_key is required for the gemini provider (API_KEY)")
+		check(c.LLMModel != "", "llm_model is required for the gemini provider")
+	}
+	check(c.LLMTimeout > 0, "llm_timeout must be positive")
+	check(c.MaxContextTokens >= 0, "max_context_tokens must not be negative")
+	check(oneOf(c.Tokenizer, "estimate", "gemini"), "tokenizer must be estimate or gemini, got %q", c.Tokenizer)
+
+	check(c.ChunkSize > 0, "chunk_size must be positive")
+	check(oneOf(c.Reranker, "", "llm", "lexical"), "reranker must be llm, lexical or empty, got %q", c.Reranker)
+	check(c.RetrievalVectorWeight >= 0 && c.RetrievalKeywordWeight >= 0, "retrieval weights must not be negative")
+	check(c.RetrievalVectorWeight+c.RetrievalKeywordWeight > 0, "at least one retrieval weight must be positive")
+	check(c.RetrievalRRFK > 0, "retrieval_rrf_k must be positive")
+
+	check(oneOf(c.HubBackplane, "memory", "postgres"), "hub_backplane must be memory or postgres, got %q", c.HubBackplane)
+	check(c.WorkerConcurrency > 0, "worker_concurrency must be positive")
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  - " + strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// Copy of the configuration that is safe to print: the API key is hidden
+// and so is the database password, whether it is in the userinfo or the
+// password parameter
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	if redacted.APIKey != "" {
+		redacted.APIKey = "REDACTED"
+	}
+	// Key=value connection strings can't be redacted piecemeal
+	if u, err := url.Parse(redacted.DatabaseURL); err == nil && u.Scheme != "" {
+		if query := u.Query(); query.Has("password") {
+			query.Set("password", "xxxxx")
+			u.RawQuery = query.Encode()
+		}
+		redacted.DatabaseURL = u.Redacted()
+	} else if redacted.DatabaseURL != "" {
+		redacted.DatabaseURL = "REDACTED"
+	}
+	return &redacted
+}
+
+// The config command: print the effective configuration as YAML with
+// secrets redacted, then report whether it is valid
+func runConfig(args []string) int {
+	c, err := loadConfig("config", args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	out, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode configuration: %v\n", err)
+		return 1
+	}
+	os.Stdout.Write(out)
+
+	if err := c.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// QueryDebug describes exactly what the model saw for a query. It is returned
+// when a client sets the debug flag on /ask or a WebSocket query.
+type QueryDebug struct {
+	Question     string         `json:"question"`
+	Queries      []string       `json:"queries"`
+	Prompt       string         `json:"prompt"`
+	PromptTokens int            `json:"prompt_tokens"`
+	AnswerTokens int            `json:"answer_tokens"`
+	Chunks       []ContextChunk `json:"chunks"`
+}
+
+// Build the debug payload for an answered query
+func newQueryDebug(result *RetrievalResult, prompt AnswerPrompt, answer string) *QueryDebug {
+	return &QueryDebug{
+		Question:     result.Question,
+		Queries:      result.Queries,
+		Prompt:       prompt.Text,
+		PromptTokens: prompt.PromptTokens,
+		AnswerTokens: tokenizer.CountTokens(answer),
+		Chunks:       prompt.Chunks,
+	}
+}
+
+type RetrieveRequest struct {
+	Query  string `json:"query" binding:"required"`
+	UserID string `json:"user_id,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+
+	// Query pipeline toggles; unset means the deployment default
+	Rewrite *bool `json:"rewrite,omitempty"`
+	Expand  *bool `json:"expand,omitempty"`
+}
+
+// Run retrieval for a query without calling the LLM and return the ranked
+// chunks with their scores
+func retrieveHandler(c *gin.Context) {
+	documentID := c.Param("documentId")
+
+	var req RetrieveRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	var documentExists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM documents WHERE id = $1)", documentID).Scan(&documentExists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to verify document: " + err.Error(),
+		})
+		return
+	}
+
+	if !documentExists {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Success: false,
+			Error:   "Document not found",
+		})
+		return
+	}
+
+	opts := resolveQueryOptions(req.Rewrite, req.Expand)
+	history := loadHistory(c.Request.Context(), documentID, req.UserID, req.Query)
+	result, err := retrieveForQuery(c.Request.Context(), documentID, req.Query, history, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to retrieve chunks: " + err.Error(),
+		})
+		return
+	}
+
+	if req.Limit > 0 && len(result.Chunks) > req.Limit {
+		result.Chunks = result.Chunks[:req.Limit]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"question": result.Question,
+		"queries":  result.Queries,
+		"chunks":   result.Chunks,
+	})
+}
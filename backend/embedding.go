@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Dimension of the vectors produced by the embedding model
+const embeddingDimensions = 768
+
+// Gemini accepts at most 100 texts per batchEmbedContents call
+const embeddingBatchSize = 100
+
+// Call the Gemini embedding API for a list of texts. The request is aborted
+// when ctx is cancelled.
+func callGeminiEmbedAPI(ctx context.Context, texts []string) ([][]float32, error) {
+	var embeddings [][]float32
+
+	for start := 0; start < len(texts); start += embeddingBatchSize {
+		end := start + embeddingBatchSize
+		if end > len(texts) {
+			end = len(texts)
+		}
+
+		requests := make([]map[string]interface{}, 0, end-start)
+		for _, text := range texts[start:end] {
+			requests = append(requests, map[string]interface{}{
+				"model": "models/text-embedding-004",
+				"content": map[string]interface{}{
+					"parts": []map[string]interface{}{
+						{"text": text},
+					},
+				},
+			})
+		}
+
+		jsonBody, err := json.Marshal(map[string]interface{}{"requests": requests})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal embedding request: %v", err)
+		}
+
+		url := "https://generativelanguage.googleapis.com/v1beta/models/text-embedding-004:batchEmbedContents?key=" + cfg.APIKey
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(string(jsonBody)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create embedding request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := geminiClient().Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("failed to call Gemini embedding API: %v", err)
+		}
+
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read embedding response: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Gemini embedding API returned status %d: %s", resp.StatusCode, string(respBody))
+		}
+
+		var embedResp struct {
+			Embeddings []struct {
+				Values []float32 `json:"values"`
+			} `json:"embeddings"`
+		}
+		if err := json.Unmarshal(respBody, &embedResp); err != nil {
+			return nil, fmt.Errorf("failed to parse embedding response: %v", err)
+		}
+
+		if len(embedResp.Embeddings) != end-start {
+			return nil, fmt.Errorf("expected %d embeddings, got %d", end-start, len(embedResp.Embeddings))
+		}
+
+		for _, e := range embedResp.Embeddings {
+			embeddings = append(embeddings, e.Values)
+		}
+	}
+
+	return embeddings, nil
+}
+
+// Encode an embedding as little-endian float32 bytes for the BYTEA column
+func encodeEmbedding(embedding []float32) []byte {
+	buf := make([]byte, 4*len(embedding))
+	for i, v := range embedding {
+		binary.LittleEndian.PutUint32(buf[i*4:], math.Float32bits(v))
+	}
+	return buf
+}
+
+// Decode an embedding stored by encodeEmbedding
+func decodeEmbedding(buf []byte) []float32 {
+	embedding := make([]float32, len(buf)/4)
+	for i := range embedding {
+		embedding[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[i*4:]))
+	}
+	return embedding
+}
+
+// Format an embedding as a pgvector literal, e.g. [0.1,0.2,0.3]
+func formatVector(embedding []float32) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, v := range embedding {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatFloat(float64(v), 'f', -1, 32))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// Cosine similarity between two embeddings
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/lib/pq"
+)
+
+// User and collection that evaluation documents are ingested under
+const (
+	evalUserID     = "docsy-eval"
+	evalCollection = "eval"
+)
+
+// EvalDataset is the input of `docsy eval`. Document paths are relative to
+// the dataset file.
+//
+//	{
+//	  "documents": [{"id": "lease", "path": "docs/lease.pdf", "template": "legal_contract"}],
+//	  "cases": [{"document": "lease", "question": "When does the lease end?",
+//	             "expected_answer": "31 March 2026", "expected_pages": [2]}]
+//	}
+type EvalDataset struct {
+	Documents []EvalDocument `json:"documents"`
+	Cases     []EvalCase     `json:"cases"`
+}
+
+type EvalDocument struct {
+	ID       string `json:"id"`
+	Path     string `json:"path"`
+	Template string `json:"template,omitempty"`
+}
+
+type EvalCase struct {
+	Document       string `json:"document"`
+	Question       string `json:"question"`
+	ExpectedAnswer string `json:"expected_answer,omitempty"`
+	ExpectedPages  []int  `json:"expected_pages,omitempty"`
+}
+
+// EvalCaseResult holds the scores of one case. Scores are null when the case
+// has nothing to score against.
+type EvalCaseResult struct {
+	Document         string   `json:"document"`
+	Question         string   `json:"question"`
+	ExpectedAnswer   string   `json:"expected_answer,omitempty"`
+	Answer           string   `json:"answer"`
+	ExpectedPages    []int    `json:"expected_pages,omitempty"`
+	RetrievedPages   []int    `json:"retrieved_pages"`
+	ContextPages     []int    `json:"context_pages"`
+	CitedPages       []int    `json:"cited_pages"`
+	RecallAtK        *float64 `json:"recall_at_k"`
+	ContextPrecision *float64 `json:"context_precision"`
+	CitationAccuracy *float64 `json:"citation_accuracy"`
+	AnswerScore      *float64 `json:"answer_score"`
+	Error            string   `json:"error,omitempty"`
+}
+
+// EvalSummary averages each score over the cases that have it
+type EvalSummary struct {
+	Cases            int      `json:"cases"`
+	Errors           int      `json:"errors"`
+	RecallAtK        *float64 `json:"recall_at_k"`
+	ContextPrecision *float64 `json:"context_precision"`
+	CitationAccuracy *float64 `json:"citation_accuracy"`
+	AnswerMatch      *float64 `json:"answer_match"`
+}
+
+// EvalReport is the output of `docsy eval`. It has no timestamps or IDs so
+// that reports from two runs can be diffed directly.
+type EvalReport struct {
+	Provider  string           `json:"provider"`
+	Model     string           `json:"model"`
+	K         int              `json:"k"`
+	ChunkSize int              `json:"chunk_size"`
+	Rewrite   bool             `json:"rewrite"`
+	Expand    bool             `json:"expand"`
+	Reranker  string           `json:"reranker"`
+	Summary   EvalSummary      `json:"summary"`
+	Results   []EvalCaseResult `json:"results"`
+}
+
+// Run the eval command and return the process exit code.
+//
+// Every dataset document is ingested with the configured chunk size, every
+// case is run through retrieval, prompt assembly and generation, and the
+// report is written as JSON. Metrics:
+//   - recall@k: share of the expected pages found among the top k chunks
+//   - context precision: share of the pages of the chunks placed in the
+//     prompt that are expected pages
+//   - citation accuracy: share of the pages the answer cites that are
+//     expected pages; an answer citing no pages scores 0
+//   - answer match: token-level F1 between the answer, without its
+//     citations, and the expected answer
+//
+// The documents are ingested into the database given by -database-url or
+// EVAL_DATABASE_URL, which must not be the server's database. The fake
+// provider makes no API calls, but the run still needs Postgres.
+func runEval(args []string) int {
+	flags := flag.NewFlagSet("eval", flag.ContinueOnError)
+	datasetPath := flags.String("dataset", "", "path to the evaluation dataset (JSON)")
+	providerName := flags.String("provider", cfg.LLMProvider, "LLM provider: gemini or fake")
+	k := flags.Int("k", 5, "number of retrieved chunks scored for recall@k")
+	chunkSize := flags.Int("chunk-size", cfg.ChunkSize, "maximum characters per chunk at ingestion")
+	rewrite := flags.Bool("rewrite", false, "enable query rewriting")
+	expand := flags.Bool("expand", false, "enable multi-query expansion")
+	outPath := flags.String("out", "", "write the report to this file instead of stdout")
+	keep := flags.Bool("keep", false, "keep the ingested documents after the run")
+	databaseURL := flags.String("database-url", os.Getenv("EVAL_DATABASE_URL"), "PostgreSQL connection string of the database to evaluate in (default EVAL_DATABASE_URL)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *datasetPath == "" {
+		fmt.Fprintln(os.Stderr, "eval: -dataset is required")
+		flags.Usage()
+		return 2
+	}
+
+	dataset, err := loadEvalDataset(*datasetPath)
+	if err != nil {
+		log.Printf("eval: %v", err)
+		return 1
+	}
+
+	// Eval documents never go into the server's database
+	if *databaseURL == "" {
+		fmt.Fprintln(os.Stderr, "eval: -database-url or EVAL_DATABASE_URL is required; use a database of its own")
+		return 2
+	}
+	if *databaseURL == cfg.DatabaseURL {
+		fmt.Fprintln(os.Stderr, "eval: the eval database must not be the server's DATABASE_URL")
+		return 2
+	}
+	cfg.DatabaseURL = *databaseURL
+
+	cfg.LLMProvider = *providerName
+	if err := cfg.Validate(); err != nil {
+		log.Printf("eval: %v", err)
+		return 1
+	}
+
+	if err := initServices(); err != nil {
+		log.Printf("eval: %v", err)
+		return 1
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	documentIDs, err := ingestEvalDocuments(ctx, dataset, filepath.Dir(*datasetPath), *chunkSize)
+	if !*keep {
+		defer deleteEvalDocuments(ctx, documentIDs)
+	}
+	if err != nil {
+		log.Printf("eval: %v", err)
+		return 1
+	}
+
+	report := EvalReport{
+		Provider:  *providerName,
+		Model:     provider.Model(),
+		K:         *k,
+		ChunkSize: *chunkSize,
+		Rewrite:   *rewrite,
+		Expand:    *expand,
+		Reranker:  cfg.Reranker,
+	}
+	if report.Provider == "" {
+		report.Provider = "gemini"
+	}
+
+	opts := QueryOptions{Rewrite: *rewrite, Expand: *expand}
+	for i, evalCase := range dataset.Cases {
+		log.Printf("eval: case %d/%d", i+1, len(dataset.Cases))
+		report.Results = append(report.Results, runEvalCase(ctx, documentIDs[evalCase.Document], evalCase, opts, *k))
+	}
+	report.Summary = summarizeEval(report.Results)
+
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Printf("eval: failed to encode report: %v", err)
+		return 1
+	}
+	output = append(output, '\n')
+
+	if *outPath == "" {
+		os.Stdout.Write(output)
+	} else if err := os.WriteFile(*outPath, output, 0644); err != nil {
+		log.Printf("eval: failed to write report: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// Read and check a dataset file
+func loadEvalDataset(path string) (*EvalDataset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dataset: %v", err)
+	}
+
+	var dataset EvalDataset
+	if err := json.Unmarshal(data, &dataset); err != nil {
+		return nil, fmt.Errorf("failed to parse dataset: %v", err)
+	}
+
+	documents := make(map[string]bool, len(dataset.Documents))
+	for _, doc := range dataset.Documents {
+		if doc.ID == "" || doc.Path == "" {
+			return nil, fmt.Errorf("every document needs an id and a path")
+		}
+		documents[doc.ID] = true
+	}
+	for i, evalCase := range dataset.Cases {
+		if !documents[evalCase.Document] {
+			return nil, fmt.Errorf("case %d refers to unknown document %q", i+1, evalCase.Document)
+		}
+		if evalCase.Question == "" {
+			return nil, fmt.Errorf("case %d has no question", i+1)
+		}
+	}
+	return &dataset, nil
+}
+
+// Ingest the dataset's documents the same way uploads are ingested,
+// returning the stored document ID for each dataset document ID
+func ingestEvalDocuments(ctx context.Context, dataset *EvalDataset, baseDir string, chunkSize int) (map[string]string, error) {
+	if _, err := createOrGetUser(ctx, evalUserID, evalUserID+"@example.com"); err != nil {
+		return nil, fmt.Errorf("failed to create eval user: %v", err)
+	}
+
+	documentIDs := make(map[string]string, len(dataset.Documents))
+	for _, doc := range dataset.Documents {
+		path := doc.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return documentIDs, fmt.Errorf("document %s: %v", doc.ID, err)
+		}
+
+		pages, err := extractText(path)
+		if err != nil {
+			return documentIDs, fmt.Errorf("document %s: failed to extract text: %v", doc.ID, err)
+		}
+
+		chunks := splitPagesIntoChunks(pages, chunkSize)
+		if len(chunks) == 0 {
+			return documentIDs, fmt.Errorf("document %s: no text content found", doc.ID)
+		}
+
+		document, err := saveDocument(ctx, evalUserID, filepath.Base(path), path, info.Size(), evalCollection, doc.Template)
+		if err != nil {
+			return documentIDs, fmt.Errorf("document %s: %v", doc.ID, err)
+		}
+		documentIDs[doc.ID] = document.ID
+
+		if err := saveDocumentChunks(ctx, document.ID, chunks); err != nil {
+			return documentIDs, fmt.Errorf("document %s: failed to save chunks: %v", doc.ID, err)
+		}
+		log.Printf("eval: ingested %s (%d chunks)", doc.ID, len(chunks))
+	}
+
+	return documentIDs, nil
+}
+
+// Remove the documents ingested for a run
+func deleteEvalDocuments(ctx context.Context, documentIDs map[string]string) {
+	ids := make([]string, 0, len(documentIDs))
+	for _, id := range documentIDs {
+		ids = append(ids, id)
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM documents WHERE id = ANY($1)", pq.Array(ids)); err != nil {
+		log.Printf("eval: failed to delete documents: %v", err)
+	}
+}
+
+// Run one case through the query pipeline and score it
+func runEvalCase(ctx context.Context, documentID string, evalCase EvalCase, opts QueryOptions, k int) EvalCaseResult {
+	result := EvalCaseResult{
+		Document:       evalCase.Document,
+		Question:       evalCase.Question,
+		ExpectedAnswer: evalCase.ExpectedAnswer,
+		ExpectedPages:  evalCase.ExpectedPages,
+		RetrievedPages: []int{},
+		ContextPages:   []int{},
+		CitedPages:     []int{},
+	}
+
+	templateName, err := resolvePromptTemplate(ctx, documentID, "")
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	retrieved, err := retrieveForQuery(ctx, documentID, evalCase.Question, nil, opts)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	var retrievedPages []int
+	for i, chunk := range retrieved.Chunks {
+		if i == k {
+			break
+		}
+		retrievedPages = append(retrievedPages, chunk.PageNumber)
+	}
+	result.RetrievedPages = uniquePages(retrievedPages)
+
+	prompt, err := buildAnswerPrompt(PromptRequest{
+		Template: templateName,
+		Question: evalCase.Question,
+		Chunks:   retrieved.Chunks,
+	})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	var contextPages []int
+	for _, chunk := range prompt.Chunks {
+		if chunk.Status != chunkDropped {
+			contextPages = append(contextPages, chunk.PageNumber)
+		}
+	}
+	result.ContextPages = uniquePages(contextPages)
+
+	result.Answer, err = provider.Generate(ctx, prompt.Text)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.CitedPages = citedPages(result.Answer)
+
+	if len(evalCase.ExpectedPages) > 0 {
+		expected := make(map[int]bool)
+		for _, page := range evalCase.ExpectedPages {
+			expected[page] = true
+		}
+
+		found := 0
+		for _, page := range result.RetrievedPages {
+			if expected[page] {
+				found++
+			}
+		}
+		recall := float64(found) / float64(len(expected))
+		result.RecallAtK = &recall
+
+		if len(result.ContextPages) > 0 {
+			correct := 0
+			for _, page := range result.ContextPages {
+				if expected[page] {
+					correct++
+				}
+			}
+			precision := float64(correct) / float64(len(result.ContextPages))
+			result.ContextPrecision = &precision
+		}
+
+		accuracy := 0.0
+		if len(result.CitedPages) > 0 {
+			correct := 0
+			for _, page := range result.CitedPages {
+				if expected[page] {
+					correct++
+				}
+			}
+			accuracy = float64(correct) / float64(len(result.CitedPages))
+		}
+		result.CitationAccuracy = &accuracy
+	}
+
+	if evalCase.ExpectedAnswer != "" {
+		score := answerF1(stripCitations(result.Answer), evalCase.ExpectedAnswer)
+		result.AnswerScore = &score
+	}
+
+	return result
+}
+
+// Token-level F1 between an answer and the expected answer
+func answerF1(answer, expected string) float64 {
+	expectedCounts := make(map[string]int)
+	expectedTokens := tokenize(expected)
+	for _, token := range expectedTokens {
+		expectedCounts[token]++
+	}
+
+	answerTokens := tokenize(answer)
+	common := 0
+	for _, token := range answerTokens {
+		if expectedCounts[token] > 0 {
+			expectedCounts[token]--
+			common++
+		}
+	}
+	if common == 0 {
+		return 0
+	}
+
+	precision := float64(common) / float64(len(answerTokens))
+	recall := float64(common) / float64(len(expectedTokens))
+	return 2 * precision * recall / (precision + recall)
+}
+
+// Sorted distinct page numbers, ignoring unknown pages
+func uniquePages(pages []int) []int {
+	seen := make(map[int]bool)
+	unique := []int{}
+	for _, page := range pages {
+		if page > 0 && !seen[page] {
+			seen[page] = true
+			unique = append(unique, page)
+		}
+	}
+	sort.Ints(unique)
+	return unique
+}
+
+// Average each score over the cases that have it
+func summarizeEval(results []EvalCaseResult) EvalSummary {
+	summary := EvalSummary{Cases: len(results)}
+
+	var recall, precision, citation, answer []float64
+	for _, result := range results {
+		if result.Error != "" {
+			summary.Errors++
+		}
+		if result.RecallAtK != nil {
+			recall = append(recall, *result.RecallAtK)
+		}
+		if result.ContextPrecision != nil {
+			precision = append(precision, *result.ContextPrecision)
+		}
+		if result.CitationAccuracy != nil {
+			citation = append(citation, *result.CitationAccuracy)
+		}
+		if result.AnswerScore != nil {
+			answer = append(answer, *result.AnswerScore)
+		}
+	}
+
+	summary.RecallAtK = mean(recall)
+	summary.ContextPrecision = mean(precision)
+	summary.CitationAccuracy = mean(citation)
+	summary.AnswerMatch = mean(answer)
+	return summary
+}
+
+func mean(values []float64) *float64 {
+	if len(values) == 0 {
+		return nil
+	}
+	total := 0.0
+	for _, v := range values {
+		total += v
+	}
+	m := total / float64(len(values))
+	return &m
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Extra attempts made when the model's output fails schema validation
+const extractionRepairAttempts = 2
+
+// Extraction run statuses
+const (
+	extractionSucceeded = "succeeded"
+	extractionFailed    = "failed"
+)
+
+// ExtractionCitation points an extracted field at the text it came from
+type ExtractionCitation struct {
+	Field      string `json:"field"`
+	ChunkIndex int    `json:"chunk_index"`
+	PageNumber int    `json:"page_number,omitempty"`
+	Quote      string `json:"quote,omitempty"`
+}
+
+// ExtractionRun is a stored structured-extraction result
+type ExtractionRun struct {
+	ID         string               `json:"id"`
+	DocumentID string               `json:"document_id"`
+	UserID     string               `json:"user_id,omitempty"`
+	BatchID    string               `json:"batch_id,omitempty"`
+	Schema     json.RawMessage      `json:"schema"`
+	Result     json.RawMessage      `json:"result,omitempty"`
+	Citations  []ExtractionCitation `json:"citations,omitempty"`
+	Status     string               `json:"status"`
+	Error      string               `json:"error,omitempty"`
+	Attempts   int                  `json:"attempts"`
+	// Chunks left out of the prompt because the context budget ran out;
+	// fields found only in those chunks can't have been extracted
+	DroppedChunks int       `json:"dropped_chunks"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type ExtractRequest struct {
+	Schema json.RawMessage `json:"schema" binding:"required"`
+	UserID string          `json:"user_id,omitempty"`
+}
+
+// Parse and check a user-supplied extraction schema
+func parseExtractionSchema(raw json.RawMessage) (map[string]interface{}, error) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, fmt.Errorf("schema is not a JSON object: %v", err)
+	}
+	if err := checkExtractionSchema(schema); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// Strip a Markdown code fence the model sometimes wraps JSON in
+func stripCodeFence(text string) string {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "```") {
+		text = strings.TrimPrefix(text, "```json")
+		text = strings.TrimPrefix(text, "```")
+		text = strings.TrimSuffix(strings.TrimSpace(text), "```")
+	}
+	return strings.TrimSpace(text)
+}
+
+// Lay out chunks in document order with markers the model can cite. Chunks
+// after the first one that doesn't fit the budget are left out; the ones
+// that went in are returned with the text.
+func formatCitableChunks(chunks []RetrievedChunk, budget int) (string, []RetrievedChunk) {
+	var content strings.Builder
+	remaining := budget
+	for i, chunk := range chunks {
+		text := fmt.Sprintf("[chunk %d, page %d]\n%s\n\n", chunk.ChunkIndex, chunk.PageNumber, chunk.Content)
+		tokens := estimator.CountTokens(text)
+		if tokens > remaining {
+			return content.String(), chunks[:i]
+		}
+		content.WriteString(text)
+		remaining -= tokens
+	}
+	return content.String(), chunks
+}
+
+// Parse the model's extraction output and validate it against the schema.
+// Citations must point at a chunk in pages, the chunks that were in the
+// prompt, and are given that chunk's page number.
+func parseExtractionOutput(output string, schema map[string]interface{}, pages map[int]int) (json.RawMessage, []ExtractionCitation, []string) {
+	var parsed struct {
+		Data      json.RawMessage `json:"data"`
+		Citations []struct {
+			Field string `json:"field"`
+			Chunk int    `json:"chunk"`
+			Quote string `json:"quote"`
+		} `json:"citations"`
+	}
+	if err := json.Unmarshal([]byte(stripCodeFence(output)), &parsed); err != nil {
+		return nil, nil, []string{"output is not valid JSON: " + err.Error()}
+	}
+	if len(parsed.Data) == 0 {
+		return nil, nil, []string{`output has no "data" object`}
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(parsed.Data, &data); err != nil {
+		return nil, nil, []string{"data is not valid JSON: " + err.Error()}
+	}
+	if errs := validateJSONSchema(schema, data); len(errs) > 0 {
+		return nil, nil, errs
+	}
+
+	citations := make([]ExtractionCitation, 0, len(parsed.Citations))
+	var errs []string
+	for _, c := range parsed.Citations {
+		page, ok := pages[c.Chunk]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("citation for %s refers to chunk %d, which is not in the document", c.Field, c.Chunk))
+			continue
+		}
+		citations = append(citations, ExtractionCitation{Field: c.Field, ChunkIndex: c.Chunk, PageNumber: page, Quote: c.Quote})
+	}
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+	return parsed.Data, citations, nil
+}
+
+// Extract structured data from a document. The output is validated against
+// the schema and the model is asked to repair it when validation fails.
+func runExtraction(ctx context.Context, documentID string, schema map[string]interface{}) (*ExtractionRun, error) {
+	schemaJSON, err := json.Marshal(schema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode schema: %v", err)
+	}
+
+	run := &ExtractionRun{
+		ID:         uuid.New().String(),
+		DocumentID: documentID,
+		Schema:     schemaJSON,
+		CreatedAt:  time.Now(),
+	}
+
+	chunks, err := getOrderedChunks(ctx, documentID)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		run.Status = extractionFailed
+		run.Error = "no content found for this document"
+		return run, nil
+	}
+
+	budget := budgetForModel(provider.Model())
+	content, included := formatCitableChunks(chunks, budget.contextTokens(estimator.CountTokens(string(schemaJSON))))
+	run.DroppedChunks = len(chunks) - len(included)
+	if run.DroppedChunks > 0 {
+		log.Printf("Extraction for document %s left out %d of %d chunks to fit the context budget", documentID, run.DroppedChunks, len(chunks))
+	}
+
+	pages := make(map[int]int, len(included))
+	for _, chunk := range included {
+		pages[chunk.ChunkIndex] = chunk.PageNumber
+	}
+
+	prompt := fmt.Sprintf(`Extract data from the document below so that it conforms to this JSON Schema:
+%s
+
+Use only information stated in the document. Use null for optional fields that the document does not contain; never invent values. Keep numbers as JSON numbers and dates in ISO 8601 format when the schema asks for dates.
+
+For every field you fill in, cite the chunk it came from using the chunk number in the [chunk N, page P] markers, with a short verbatim quote.
+
+Return a JSON object of the form:
+{"data": <object conforming to the schema>, "citations": [{"field": "<JSON path such as $.invoice_number>", "chunk": <chunk number>, "quote": "<verbatim text>"}]}
+
+Document:
+%s`, schemaJSON, content)
+
+	var errs []string
+	for attempt := 0; attempt <= extractionRepairAttempts; attempt++ {
+		run.Attempts = attempt + 1
+
+		output, err := provider.GenerateJSON(ctx, prompt)
+		if err != nil {
+			run.Status = extractionFailed
+			run.Error = "failed to get response from AI: " + err.Error()
+			return run, nil
+		}
+
+		var data json.RawMessage
+		var citations []ExtractionCitation
+		data, citations, errs = parseExtractionOutput(output, schema, pages)
+		if len(errs) == 0 {
+			run.Status = extractionSucceeded
+			run.Result = data
+			run.Citations = citations
+			return run, nil
+		}
+
+		log.Printf("Extraction attempt %d for document %s failed validation: %s", attempt+1, documentID, strings.Join(errs, "; "))
+
+		prompt = fmt.Sprintf(`Your previous output did not conform to the required format.
+
+JSON Schema for "data":
+%s
+
+Previous output:
+%s
+
+Problems:
+- %s
+
+Return the corrected JSON object of the form {"data": ..., "citations": [...]}, using only information from the document:
+%s`, schemaJSON, output, strings.Join(errs, "\n- "), content)
+	}
+
+	run.Status = extractionFailed
+	run.Error = "output failed schema validation: " + strings.Join(errs, "; ")
+	return run, nil
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Store an extraction run. A batch keeps one run per document: if the
+// document already has one, nothing is stored and false is returned.
+func saveExtractionRun(ctx context.Context, q execer, run *ExtractionRun) (bool, error) {
+	citations, err := json.Marshal(run.Citations)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode citations: %v", err)
+	}
+
+	var result interface{}
+	if len(run.Result) > 0 {
+		result = string(run.Result)
+	}
+
+	res, err := q.ExecContext(ctx, `
+		INSERT INTO extraction_runs (id, document_id, user_id, batch_id, schema, result, citations, status, error, attempts, dropped_chunks, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, $6, $7, $8, NULLIF($9, ''), $10, $11, $12)
+		ON CONFLICT (batch_id, document_id) WHERE batch_id IS NOT NULL DO NOTHING`,
+		run.ID, run.DocumentID, run.UserID, run.BatchID, string(run.Schema), result, string(citations), run.Status, run.Error, run.Attempts, run.DroppedChunks, run.CreatedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to save extraction run: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to save extraction run: %v", err)
+	}
+	return n > 0, nil
+}
+
+// Columns selected for an ExtractionRun, in scanExtractionRun order
+const extractionRunColumns = `id, document_id, COALESCE(user_id, ''), COALESCE(batch_id, ''), schema, result, citations, status, COALESCE(error, ''), attempts, dropped_chunks, created_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanExtractionRun(row rowScanner) (*ExtractionRun, error) {
+	var run ExtractionRun
+	var schema, citations string
+	var result sql.NullString
+	err := row.Scan(&run.ID, &run.DocumentID, &run.UserID, &run.BatchID, &schema, &result, &citations, &run.Status, &run.Error, &run.Attempts, &run.DroppedChunks, &run.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	run.Schema = json.RawMessage(schema)
+	if result.Valid {
+		run.Result = json.RawMessage(result.String)
+	}
+	if err := json.Unmarshal([]byte(citations), &run.Citations); err != nil {
+		log.Printf("Error decoding citations of extraction %s: %v", run.ID, err)
+	}
+	return &run, nil
+}
+
+// Run an extraction, store it and write the HTTP response
+func respondWithExtraction(c *gin.Context, documentID, userID string, schema map[string]interface{}) {
+	run, err := runExtraction(c.Request.Context(), documentID, schema)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to run extraction: " + err.Error(),
+		})
+		return
+	}
+	run.UserID = userID
+
+	if _, err := saveExtractionRun(c.Request.Context(), db, run); err != nil {
+		log.Printf("Error saving extraction run: %v", err)
+	}
+
+	status := http.StatusOK
+	if run.Status == extractionFailed {
+		status = http.StatusUnprocessableEntity
+	}
+
+	c.JSON(status, gin.H{
+		"success":    run.Status == extractionSucceeded,
+		"extraction": run,
+	})
+}
+
+// Extract structured data from a document against a JSON Schema
+func extractHandler(c *gin.Context) {
+	documentID := c.Param("documentId")
+
+	var req ExtractRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	schema, err := parseExtractionSchema(req.Schema)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "Invalid schema: " + err.Error(),
+		})
+		return
+	}
+
+	var documentExists bool
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM documents WHERE id = $1)", documentID).Scan(&documentExists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to verify document: " + err.Error(),
+		})
+		return
+	}
+
+	if !documentExists {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Success: false,
+			Error:   "Document not found",
+		})
+		return
+	}
+
+	respondWithExtraction(c, documentID, req.UserID, schema)
+}
+
+// List the extraction runs of a document, newest first
+func listExtractionsHandler(c *gin.Context) {
+	documentID := c.Param("documentId")
+
+	rows, err := db.Query("SELECT "+extractionRunColumns+" FROM extraction_runs WHERE document_id = $1 ORDER BY created_at DESC", documentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to fetch extractions: " + err.Error(),
+		})
+		return
+	}
+	defer rows.Close()
+
+	runs := []*ExtractionRun{}
+	for rows.Next() {
+		run, err := scanExtractionRun(rows)
+		if err != nil {
+			log.Printf("Error scanning extraction run: %v", err)
+			continue
+		}
+		runs = append(runs, run)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":     true,
+		"extractions": runs,
+	})
+}
+
+// Fetch a stored extraction run
+func getExtractionHandler(c *gin.Context) {
+	run, err := scanExtractionRun(db.QueryRow("SELECT "+extractionRunColumns+" FROM extraction_runs WHERE id = $1", c.Param("extractionId")))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Success: false,
+			Error:   "Extraction not found",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to fetch extraction: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":    true,
+		"extraction": run,
+	})
+}
+
+// Re-run a stored extraction with the same document and schema, storing the
+// result as a new run
+func rerunExtractionHandler(c *gin.Context) {
+	previous, err := scanExtractionRun(db.QueryRow("SELECT "+extractionRunColumns+" FROM extraction_runs WHERE id = $1", c.Param("extractionId")))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Success: false,
+			Error:   "Extraction not found",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to fetch extraction: " + err.Error(),
+		})
+		return
+	}
+
+	schema, err := parseExtractionSchema(previous.Schema)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "Invalid schema: " + err.Error(),
+		})
+		return
+	}
+
+	respondWithExtraction(c, previous.DocumentID, previous.UserID, schema)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatCitableChunksReportsIncludedChunks(t *testing.T) {
+	chunks := []RetrievedChunk{
+		{ChunkIndex: 0, PageNumber: 1, Content: strings.Repeat("word ", 40)},
+		{ChunkIndex: 1, PageNumber: 1, Content: strings.Repeat("word ", 40)},
+		{ChunkIndex: 2, PageNumber: 2, Content: strings.Repeat("word ", 40)},
+	}
+	perChunk := estimator.CountTokens("[chunk 0, page 1]\n" + chunks[0].Content + "\n\n")
+
+	content, included := formatCitableChunks(chunks, 2*perChunk)
+	if len(included) != 2 {
+		t.Fatalf("included %d chunks, want 2", len(included))
+	}
+	if strings.Contains(content, "[chunk 2,") {
+		t.Errorf("content contains the chunk that didn't fit")
+	}
+
+	if _, included := formatCitableChunks(chunks, 10*perChunk); len(included) != len(chunks) {
+		t.Errorf("included %d chunks with room for all, want %d", len(included), len(chunks))
+	}
+}
+
+func TestParseExtractionOutputCitations(t *testing.T) {
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"total": map[string]interface{}{"type": "number"}},
+	}
+	pages := map[int]int{0: 1, 3: 2}
+
+	_, citations, errs := parseExtractionOutput(`{"data": {"total": 5}, "citations": [{"field": "$.total", "chunk": 3, "quote": "Total: 5"}]}`, schema, pages)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(citations) != 1 || citations[0].PageNumber != 2 {
+		t.Errorf("citations = %+v, want chunk 3 on page 2", citations)
+	}
+
+	_, _, errs = parseExtractionOutput(`{"data": {"total": 5}, "citations": [{"field": "$.total", "chunk": 7, "quote": "Total: 5"}]}`, schema, pages)
+	if len(errs) != 1 || !strings.Contains(errs[0], "chunk 7") {
+		t.Errorf("errs = %v, want one error about chunk 7", errs)
+	}
+
+	_, _, errs = parseExtractionOutput("```json\n{\"data\": {\"total\": \"5\"}}\n```", schema, pages)
+	if len(errs) != 1 || !strings.Contains(errs[0], "$.total") {
+		t.Errorf("errs = %v, want one schema error for $.total", errs)
+	}
+}
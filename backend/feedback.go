@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Feedback ratings
+const (
+	feedbackUp   = "up"
+	feedbackDown = "down"
+)
+
+// Reasons a user can pick for their rating
+var feedbackCategories = map[string]bool{
+	"incorrect":    true,
+	"incomplete":   true,
+	"irrelevant":   true,
+	"bad_citation": true,
+	"too_long":     true,
+	"helpful":      true,
+	"other":        true,
+}
+
+// Report groupings and the columns they group by
+var feedbackGroupings = map[string]string{
+	"document": "m.document_id, d.file_name",
+	"template": "COALESCE(m.prompt_template, ''), COALESCE(m.prompt_template, '')",
+	"model":    "COALESCE(m.model, ''), COALESCE(m.model, '')",
+}
+
+var errFeedbackMessageNotFound = errors.New("bot message not found")
+
+type FeedbackRequest struct {
+	UserID   string `json:"user_id" binding:"required"`
+	Rating   string `json:"rating" binding:"required"`
+	Reason   string `json:"reason,omitempty"`
+	Category string `json:"category,omitempty"`
+}
+
+// Feedback is a user's rating of a bot answer. A user has one rating per
+// message; rating again replaces it.
+type Feedback struct {
+	ID        string    `json:"id"`
+	MessageID string    `json:"message_id"`
+	UserID    string    `json:"user_id"`
+	Rating    string    `json:"rating"`
+	Reason    string    `json:"reason,omitempty"`
+	Category  string    `json:"category,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Feedback totals for one document, template or model
+type FeedbackGroup struct {
+	Key        string         `json:"key"`
+	Label      string         `json:"label"`
+	Up         int            `json:"up"`
+	Down       int            `json:"down"`
+	Total      int            `json:"total"`
+	DownRate   float64        `json:"down_rate"`
+	Categories map[string]int `json:"categories"`
+}
+
+// Check a feedback request
+func validateFeedback(req *FeedbackRequest) error {
+	req.Rating = strings.ToLower(req.Rating)
+	if req.Rating != feedbackUp && req.Rating != feedbackDown {
+		return fmt.Errorf("rating must be up or down")
+	}
+	if req.Category != "" && !feedbackCategories[req.Category] {
+		return fmt.Errorf("category must be one of incorrect, incomplete, irrelevant, bad_citation, too_long, helpful or other")
+	}
+	return nil
+}
+
+// Record feedback against a bot message. Users can only rate answers in
+// their own conversations.
+func saveFeedback(ctx context.Context, messageID string, req FeedbackRequest) (*Feedback, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS(SELECT 1 FROM chat_messages WHERE id = $1 AND user_id = $2 AND message_type = 'bot')`,
+		messageID, req.UserID).Scan(&exists)
+	if err == nil && !exists {
+		return nil, errFeedbackMessageNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to fetch message: %v", err)
+	}
+
+	feedback := &Feedback{
+		ID:        uuid.New().String(),
+		MessageID: messageID,
+		UserID:    req.UserID,
+		Rating:    req.Rating,
+		Reason:    strings.TrimSpace(req.Reason),
+		Category:  req.Category,
+		CreatedAt: time.Now(),
+	}
+
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO message_feedback (id, message_id, user_id, rating, reason, category, created_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''), $7)
+		ON CONFLICT (message_id, user_id)
+		DO UPDATE SET rating = EXCLUDED.rating, reason = EXCLUDED.reason,
+			category = EXCLUDED.category, created_at = EXCLUDED.created_at
+		RETURNING id`,
+		feedback.ID, messageID, req.UserID, feedback.Rating, feedback.Reason, feedback.Category, feedback.CreatedAt).
+		Scan(&feedback.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save feedback: %v", err)
+	}
+
+	return feedback, nil
+}
+
+// Handle feedback messages
+func (c *Client) handleFeedback(msg WSMessage) {
+	req := FeedbackRequest{
+		UserID:   c.userID,
+		Rating:   msg.Rating,
+		Reason:   msg.Content,
+		Category: msg.Category,
+	}
+	if err := validateFeedback(&req); err != nil {
+		c.sendError(msg.RequestID, wsErrInvalidRequest, err.Error())
+		return
+	}
+
+	feedback, err := saveFeedback(context.Background(), msg.MessageID, req)
+	if err == errFeedbackMessageNotFound {
+		c.sendError(msg.RequestID, wsErrNotFound, "Message not found")
+		return
+	} else if err != nil {
+		log.Printf("Error saving feedback: %v", err)
+		c.sendError(msg.RequestID, wsErrInternal, "Failed to save feedback: "+err.Error())
+		return
+	}
+
+	c.sendResponse(WSResponse{
+		Type:      wsFeedbackAck,
+		Content:   feedback.Rating,
+		ID:        feedback.ID,
+		RequestID: msg.RequestID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+}
+
+// Rate a bot answer
+func feedbackHandler(c *gin.Context) {
+	var req FeedbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	if err := validateFeedback(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	feedback, err := saveFeedback(c.Request.Context(), c.Param("messageId"), req)
+	if err == errFeedbackMessageNotFound {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Success: false,
+			Error:   "Message not found",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"feedback": feedback,
+	})
+}
+
+// Aggregated feedback by document, prompt template or model.
+//
+// Query parameters: groupBy (document, template or model; default document),
+// from and to (feedback date range). Groups are sorted by down-vote rate so
+// regressions come first.
+func feedbackReportHandler(c *gin.Context) {
+	groupBy := c.DefaultQuery("groupBy", "document")
+	columns, ok := feedbackGroupings[groupBy]
+	if !ok {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "groupBy must be document, template or model",
+		})
+		return
+	}
+
+	var from, to *time.Time
+	if value := c.Query("from"); value != "" {
+		t, err := parseSearchDate(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Success: false,
+				Error:   "Invalid from date: " + err.Error(),
+			})
+			return
+		}
+		from = &t
+	}
+	if value := c.Query("to"); value != "" {
+		t, err := parseSearchDate(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Success: false,
+				Error:   "Invalid to date: " + err.Error(),
+			})
+			return
+		}
+		// A bare date includes the whole day
+		if len(value) == len("2006-01-02") {
+			t = t.Add(24 * time.Hour)
+		}
+		to = &t
+	}
+
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT `+columns+`, f.rating, COALESCE(f.category, ''), COUNT(*)
+		FROM message_feedback f
+		JOIN chat_messages m ON m.id = f.message_id
+		JOIN documents d ON d.id = m.document_id
+		WHERE ($1::timestamptz IS NULL OR f.created_at >= $1)
+			AND ($2::timestamptz IS NULL OR f.created_at < $2)
+		GROUP BY 1, 2, 3, 4`, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to fetch feedback: " + err.Error(),
+		})
+		return
+	}
+	defer rows.Close()
+
+	groups := []*FeedbackGroup{}
+	groupIndex := make(map[string]*FeedbackGroup)
+	for rows.Next() {
+		var key, label, rating, category string
+		var count int
+		if err := rows.Scan(&key, &label, &rating, &category, &count); err != nil {
+			log.Printf("Error scanning feedback: %v", err)
+			continue
+		}
+
+		group, ok := groupIndex[key]
+		if !ok {
+			group = &FeedbackGroup{Key: key, Label: label, Categories: make(map[string]int)}
+			groupIndex[key] = group
+			groups = append(groups, group)
+		}
+		if rating == feedbackUp {
+			group.Up += count
+		} else {
+			group.Down += count
+		}
+		group.Total += count
+		if category != "" {
+			group.Categories[category] += count
+		}
+	}
+
+	for _, group := range groups {
+		group.DownRate = float64(group.Down) / float64(group.Total)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].DownRate != groups[j].DownRate {
+			return groups[i].DownRate > groups[j].DownRate
+		}
+		return groups[i].Total > groups[j].Total
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"group_by": groupBy,
+		"groups":   groups,
+	})
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Document every test user can open a WebSocket for
+const testDocumentID = "doc-1"
+
+// Content of the test document's only chunk
+const testChunkContent = "The lease between Acme Ltd and the tenant ends on 31 March 2030 and renews for one year unless either party gives notice."
+
+var testHubOnce sync.Once
+
+// Point the globals the WebSocket handler uses at fakes and start the hub.
+// The hub runs for the rest of the test binary, shared by every test.
+func startTestHub() {
+	testHubOnce.Do(func() {
+		sql.Register("fake", fakeDriver{})
+		db, _ = sql.Open("fake", "")
+		promptTemplates, _ = loadPromptTemplates("")
+		gin.SetMode(gin.TestMode)
+		go hub.run()
+	})
+}
+
+// Serve /ws on a listener whose connections can be stalled
+func startTestServer(t *testing.T) (*httptest.Server, *stallingListener) {
+	t.Helper()
+	startTestHub()
+
+	r := gin.New()
+	r.GET("/ws", handleWebSocket)
+	r.DELETE("/documents/:documentId/shares/:userId", unshareDocumentHandler)
+
+	server := httptest.NewUnstartedServer(r)
+	listener := &stallingListener{Listener: server.Listener, stalled: make(map[string]bool)}
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, listener
+}
+
+// Open a WebSocket to the test document for a user, offering protocols
+func dialTestServer(server *httptest.Server, userID string, protocols ...string) (*websocket.Conn, *http.Response, error) {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?documentId=" + testDocumentID + "&userId=" + userID
+	dialer := websocket.Dialer{Subprotocols: protocols, HandshakeTimeout: 5 * time.Second}
+	return dialer.Dial(url, nil)
+}
+
+// Read the next frame, giving up after timeout
+func readFrame(conn *websocket.Conn, timeout time.Duration) (WSResponse, error) {
+	var frame WSResponse
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	err := conn.ReadJSON(&frame)
+	return frame, err
+}
+
+// fakeDriver is a database/sql driver answering the queries of the WebSocket
+// query path without a database: every user can access the test document,
+// chat messages are saved, the test document has one chunk, and everything
+// else comes back empty
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return fakeConn{}, nil
+}
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{query: query}, nil
+}
+
+func (fakeConn) Close() error {
+	return nil
+}
+
+func (fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+type fakeStmt struct {
+	query string
+}
+
+func (fakeStmt) Close() error {
+	return nil
+}
+
+func (fakeStmt) NumInput() int {
+	return -1
+}
+
+func (fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	switch {
+	case strings.Contains(s.query, "OR EXISTS(SELECT 1 FROM document_shares"):
+		return &fakeRows{columns: []string{"exists"}, rows: [][]driver.Value{{args[0] == testDocumentID}}}, nil
+	case strings.Contains(s.query, "INSERT INTO chat_messages"):
+		return &fakeRows{columns: []string{"id"}, rows: [][]driver.Value{{args[0]}}}, nil
+	case strings.Contains(s.query, "FROM document_chunks WHERE document_id = $1 ORDER BY chunk_index"):
+		return &fakeRows{
+			columns: []string{"id", "document_id", "chunk_index", "page_number", "content"},
+			rows:    [][]driver.Value{{"chunk-1", args[0], int64(0), int64(1), testChunkContent}},
+		}, nil
+	}
+	return &fakeRows{}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// stallingListener hands out connections that stop taking writes once
+// stalled, like a client that stopped reading
+type stallingListener struct {
+	net.Listener
+	mu      sync.Mutex
+	stalled map[string]bool
+}
+
+func (l *stallingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &stallingConn{Conn: conn, listener: l, closed: make(chan struct{})}, nil
+}
+
+// Stall the server side of the client connection with the given local address
+func (l *stallingListener) stall(clientAddr net.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stalled[clientAddr.String()] = true
+}
+
+func (l *stallingListener) isStalled(addr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stalled[addr]
+}
+
+type stallingConn struct {
+	net.Conn
+	listener *stallingListener
+	closed   chan struct{}
+	once     sync.Once
+
+	mu            sync.Mutex
+	writeDeadline time.Time
+}
+
+// Block a stalled connection's writes until it is closed or its write
+// deadline passes
+func (c *stallingConn) Write(p []byte) (int, error) {
+	if !c.listener.isStalled(c.RemoteAddr().String()) {
+		return c.Conn.Write(p)
+	}
+
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *stallingConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *stallingConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *stallingConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// Removing a user's share closes their open connections to the document and
+// leaves other users connected
+func TestUnshareClosesConnections(t *testing.T) {
+	server, _ := startTestServer(t)
+
+	revoked, _, err := dialTestServer(server, "revoked-user")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer revoked.Close()
+	other, _, err := dialTestServer(server, "other-user")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer other.Close()
+	for _, conn := range []*websocket.Conn{revoked, other} {
+		if frame, err := readFrame(conn, 5*time.Second); err != nil || frame.Type != wsReady {
+			t.Fatalf("first frame = %+v, %v; want ready", frame, err)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/documents/"+testDocumentID+"/shares/revoked-user?requesterId=revoked-user", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unshare: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unshare status = %d, want 200", resp.StatusCode)
+	}
+
+	for {
+		_, err := readFrame(revoked, 5*time.Second)
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Fatalf("revoked connection ended with %v, want close code %d", err, websocket.ClosePolicyViolation)
+		}
+		break
+	}
+
+	// The other user stays in the room and sees the revoked user leave
+	for {
+		frame, err := readFrame(other, 5*time.Second)
+		if err != nil {
+			t.Fatalf("other connection: %v", err)
+		}
+		if frame.Type == wsPresence && len(frame.Users) == 1 && frame.Users[0] == "other-user" {
+			break
+		}
+	}
+}
+
+// Many clients query the same document at once while some drop their
+// connection mid-query and others stop reading. Clients that keep reading
+// must get an outcome for every query, and clients that stop reading must
+// be evicted without holding up the rest. Run with -race.
+func TestHubConcurrentQueriesWithDroppedAndSlowClients(t *testing.T) {
+	server, listener := startTestServer(t)
+
+	previous := provider
+	provider = FakeProvider{}
+	defer func() {
+		// Queries outlive their connections; wait for them before restoring
+		// the provider they read
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := waitGroupContext(ctx, &inflightQueries); err != nil {
+			t.Errorf("queries still running after the test: %v", err)
+		}
+		provider = previous
+	}()
+
+	const (
+		fastClients = 12
+		slowClients = 3
+		queries     = 5
+		typing      = 30
+	)
+
+	// The observer watches presence for the slow clients to be evicted
+	observer, _, err := dialTestServer(server, "observer")
+	if err != nil {
+		t.Fatalf("dial observer: %v", err)
+	}
+	defer observer.Close()
+	evicted := make(chan struct{})
+	go func() {
+		joined := false
+		for {
+			frame, err := readFrame(observer, 30*time.Second)
+			if err != nil {
+				return
+			}
+			if frame.Type != wsPresence {
+				continue
+			}
+			slow := 0
+			for _, user := range frame.Users {
+				if strings.HasPrefix(user, "slow-") {
+					slow++
+				}
+			}
+			if slow == slowClients {
+				joined = true
+			} else if joined && slow == 0 {
+				close(evicted)
+				return
+			}
+		}
+	}()
+
+	// Slow clients stop reading once connected
+	for i := 0; i < slowClients; i++ {
+		conn, _, err := dialTestServer(server, fmt.Sprintf("slow-%d", i))
+		if err != nil {
+			t.Fatalf("dial slow client: %v", err)
+		}
+		defer conn.Close()
+		if frame, err := readFrame(conn, 5*time.Second); err != nil || frame.Type != wsReady {
+			t.Fatalf("slow client got %+v, %v; want a ready frame", frame, err)
+		}
+		listener.stall(conn.LocalAddr())
+	}
+
+	// A third of the fast clients drop their connection without waiting
+	// for their answers, and some cancel their last query
+	random := rand.New(rand.NewSource(1))
+	drops := make([]bool, fastClients)
+	cancels := make([]bool, fastClients)
+	for i := range drops {
+		drops[i] = random.Intn(3) == 0
+		cancels[i] = random.Intn(2) == 0
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, fastClients)
+	for i := 0; i < fastClients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := runFastClient(server, fmt.Sprintf("user-%d", i), queries, typing, drops[i], cancels[i]); err != nil {
+				errs <- fmt.Errorf("user-%d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	select {
+	case <-evicted:
+	case <-time.After(10 * time.Second):
+		t.Error("slow clients were not evicted")
+	}
+}
+
+// Send queries and typing frames, then wait for an outcome of every query
+// unless the client drops its connection instead
+func runFastClient(server *httptest.Server, userID string, queries, typing int, drop, cancel bool) error {
+	conn, _, err := dialTestServer(server, userID)
+	if err != nil {
+		return fmt.Errorf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	requestIDs := make([]string, queries)
+	pending := make(map[string]bool)
+	for q := range requestIDs {
+		requestIDs[q] = fmt.Sprintf("%s-q%d", userID, q)
+		pending[requestIDs[q]] = true
+	}
+	var mu sync.Mutex
+	done := make(chan error, 1)
+	go func() {
+		for {
+			frame, err := readFrame(conn, 20*time.Second)
+			if err != nil {
+				done <- err
+				return
+			}
+			if frame.Type == wsError && frame.Code != wsErrUnknownRequest {
+				done <- fmt.Errorf("query %s failed: %s: %s", frame.RequestID, frame.Code, frame.Content)
+				return
+			}
+			if frame.Type != wsResponse && frame.Type != wsCancelled {
+				continue
+			}
+			mu.Lock()
+			delete(pending, frame.RequestID)
+			finished := len(pending) == 0
+			mu.Unlock()
+			if finished {
+				done <- nil
+				return
+			}
+		}
+	}()
+
+	for _, requestID := range requestIDs {
+		err := conn.WriteJSON(WSMessage{Type: wsQuery, Content: "When does the lease end?", RequestID: requestID})
+		if err != nil {
+			return fmt.Errorf("send query: %v", err)
+		}
+		// Typing frames reach every other member of the room, filling the
+		// buffers of clients that stopped reading. They're paced so the
+		// buffers of clients that keep reading don't fill in a burst.
+		for n := 0; n < typing/queries; n++ {
+			if err := conn.WriteJSON(WSMessage{Type: wsTyping, Content: "start"}); err != nil {
+				return fmt.Errorf("send typing: %v", err)
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+	}
+	if cancel {
+		if err := conn.WriteJSON(WSMessage{Type: wsCancel, RequestID: requestIDs[queries-1]}); err != nil {
+			return fmt.Errorf("send cancel: %v", err)
+		}
+	}
+
+	if drop {
+		return nil
+	}
+
+	if err := <-done; err != nil {
+		mu.Lock()
+		defer mu.Unlock()
+		return fmt.Errorf("%v with %d queries unanswered", err, len(pending))
+	}
+	return nil
+}
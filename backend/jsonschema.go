@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Minimal JSON Schema validator covering the keywords extraction schemas use:
+// type, properties, required, additionalProperties, items, enum, const,
+// minimum/maximum, minLength/maxLength, minItems/maxItems, pattern, format
+// (date, date-time, email) and anyOf/oneOf. Unsupported keywords are ignored.
+// Values must be decoded with encoding/json into interface{}.
+
+// Validate a value against a schema, returning one message per violation
+func validateJSONSchema(schema map[string]interface{}, value interface{}) []string {
+	var errs []string
+	validateSchemaNode(schema, value, "$", &errs)
+	return errs
+}
+
+func validateSchemaNode(schema map[string]interface{}, value interface{}, path string, errs *[]string) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if t, ok := schema["type"]; ok && !matchesSchemaType(t, value) {
+		fail("expected type %v, got %s", t, jsonTypeName(value))
+		return
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if jsonEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value must be one of %v", enum)
+		}
+	}
+
+	if constant, ok := schema["const"]; ok && !jsonEqual(constant, value) {
+		fail("value must be %v", constant)
+	}
+
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		options, ok := schema[keyword].([]interface{})
+		if !ok {
+			continue
+		}
+		matches := 0
+		for _, option := range options {
+			if sub, ok := option.(map[string]interface{}); ok && len(validateJSONSchema(sub, value)) == 0 {
+				matches++
+			}
+		}
+		if matches == 0 {
+			fail("value must match at least one schema in %s", keyword)
+		} else if keyword == "oneOf" && matches > 1 {
+			fail("value must match exactly one schema in oneOf")
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if key, ok := name.(string); ok {
+					if _, present := v[key]; !present {
+						fail("missing required property %q", key)
+					}
+				}
+			}
+		}
+
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			propSchema, ok := properties[key].(map[string]interface{})
+			if ok {
+				validateSchemaNode(propSchema, v[key], path+"."+key, errs)
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					fail("unexpected property %q", key)
+				}
+			case map[string]interface{}:
+				validateSchemaNode(additional, v[key], path+"."+key, errs)
+			}
+		}
+
+	case []interface{}:
+		if n, ok := schemaNumber(schema, "minItems"); ok && float64(len(v)) < n {
+			fail("expected at least %v items", n)
+		}
+		if n, ok := schemaNumber(schema, "maxItems"); ok && float64(len(v)) > n {
+			fail("expected at most %v items", n)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				validateSchemaNode(items, item, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if n, ok := schemaNumber(schema, "minLength"); ok && length < n {
+			fail("expected at least %v characters", n)
+		}
+		if n, ok := schemaNumber(schema, "maxLength"); ok && length > n {
+			fail("expected at most %v characters", n)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(v) {
+				fail("value does not match pattern %s", pattern)
+			}
+		}
+		if format, ok := schema["format"].(string); ok && !matchesFormat(format, v) {
+			fail("value is not a valid %s", format)
+		}
+
+	case float64:
+		if n, ok := schemaNumber(schema, "minimum"); ok && v < n {
+			fail("value must be at least %v", n)
+		}
+		if n, ok := schemaNumber(schema, "maximum"); ok && v > n {
+			fail("value must be at most %v", n)
+		}
+	}
+}
+
+// Check a value against a "type" keyword, which may be a string or a list
+func matchesSchemaType(t interface{}, value interface{}) bool {
+	switch t := t.(type) {
+	case string:
+		return matchesTypeName(t, value)
+	case []interface{}:
+		for _, name := range t {
+			if s, ok := name.(string); ok && matchesTypeName(s, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchesTypeName(name string, value interface{}) bool {
+	switch name {
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	default:
+		return jsonTypeName(value) == name
+	}
+}
+
+// JSON type name of a decoded value
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func schemaNumber(schema map[string]interface{}, keyword string) (float64, bool) {
+	n, ok := schema[keyword].(float64)
+	return n, ok
+}
+
+func matchesFormat(format, value string) bool {
+	switch format {
+	case "date":
+		_, err := time.Parse("2006-01-02", value)
+		return err == nil
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, value)
+		return err == nil
+	case "email":
+		at := strings.LastIndex(value, "@")
+		return at > 0 && at < len(value)-1 && !strings.ContainsAny(value, " \t\n")
+	}
+	return true
+}
+
+func jsonEqual(a, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
+
+// Check that a schema is usable before running an extraction
+func checkExtractionSchema(schema map[string]interface{}) error {
+	if len(schema) == 0 {
+		return fmt.Errorf("schema is required")
+	}
+	if t, ok := schema["type"].(string); !ok || t != "object" {
+		return fmt.Errorf("schema must describe an object (\"type\": \"object\")")
+	}
+	if _, ok := schema["properties"].(map[string]interface{}); !ok {
+		return fmt.Errorf("schema must define properties")
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestValidateJSONSchema(t *testing.T) {
+	invoice := `{
+		"type": "object",
+		"properties": {
+			"number": {"type": "string", "pattern": "^INV-[0-9]+$"},
+			"total": {"type": "number", "minimum": 0},
+			"currency": {"enum": ["EUR", "USD"]},
+			"issued": {"type": "string", "format": "date"},
+			"lines": {"type": "array", "minItems": 1, "items": {"type": "object", "required": ["amount"]}},
+			"email": {"type": ["string", "null"], "format": "email"}
+		},
+		"required": ["number", "total"],
+		"additionalProperties": false
+	}`
+
+	tests := []struct {
+		name   string
+		schema string
+		value  string
+		want   []string
+	}{
+		{
+			name:   "valid object",
+			schema: invoice,
+			value:  `{"number": "INV-42", "total": 12.5, "currency": "EUR", "issued": "2024-03-01", "lines": [{"amount": 12.5}], "email": null}`,
+		},
+		{
+			name:   "missing required properties",
+			schema: invoice,
+			value:  `{}`,
+			want:   []string{`$: missing required property "number"`, `$: missing required property "total"`},
+		},
+		{
+			name:   "wrong type stops at the node",
+			schema: invoice,
+			value:  `{"number": 42, "total": "12"}`,
+			want:   []string{"$.number: expected type string, got number", "$.total: expected type number, got string"},
+		},
+		{
+			name:   "unexpected property",
+			schema: invoice,
+			value:  `{"number": "INV-1", "total": 1, "vat": 0.2}`,
+			want:   []string{`$: unexpected property "vat"`},
+		},
+		{
+			name:   "enum, minimum and pattern",
+			schema: invoice,
+			value:  `{"number": "42", "total": -1, "currency": "GBP"}`,
+			want: []string{
+				"$.currency: value must be one of [EUR USD]",
+				"$.number: value does not match pattern ^INV-[0-9]+$",
+				"$.total: value must be at least 0",
+			},
+		},
+		{
+			name:   "formats",
+			schema: invoice,
+			value:  `{"number": "INV-1", "total": 1, "issued": "01/03/2024", "email": "not an email"}`,
+			want:   []string{"$.email: value is not a valid email", "$.issued: value is not a valid date"},
+		},
+		{
+			name:   "array items",
+			schema: invoice,
+			value:  `{"number": "INV-1", "total": 1, "lines": [{"amount": 1}, {}]}`,
+			want:   []string{`$.lines[1]: missing required property "amount"`},
+		},
+		{
+			name:   "min items",
+			schema: invoice,
+			value:  `{"number": "INV-1", "total": 1, "lines": []}`,
+			want:   []string{"$.lines: expected at least 1 items"},
+		},
+		{
+			name:   "integer rejects fractions",
+			schema: `{"type": "integer", "maximum": 10}`,
+			value:  `2.5`,
+			want:   []string{"$: expected type integer, got number"},
+		},
+		{
+			name:   "integer maximum",
+			schema: `{"type": "integer", "maximum": 10}`,
+			value:  `11`,
+			want:   []string{"$: value must be at most 10"},
+		},
+		{
+			name:   "string length counts runes",
+			schema: `{"type": "string", "minLength": 2, "maxLength": 3}`,
+			value:  `"héé"`,
+		},
+		{
+			name:   "string too long",
+			schema: `{"type": "string", "maxLength": 3}`,
+			value:  `"abcd"`,
+			want:   []string{"$: expected at most 3 characters"},
+		},
+		{
+			name:   "const",
+			schema: `{"const": {"a": 1}}`,
+			value:  `{"a": 2}`,
+			want:   []string{"$: value must be map[a:1]"},
+		},
+		{
+			name:   "anyOf matches one option",
+			schema: `{"anyOf": [{"type": "string"}, {"type": "number"}]}`,
+			value:  `3`,
+		},
+		{
+			name:   "anyOf matches none",
+			schema: `{"anyOf": [{"type": "string"}, {"type": "number"}]}`,
+			value:  `true`,
+			want:   []string{"$: value must match at least one schema in anyOf"},
+		},
+		{
+			name:   "oneOf matches more than one",
+			schema: `{"oneOf": [{"type": "number"}, {"type": "integer"}]}`,
+			value:  `3`,
+			want:   []string{"$: value must match exactly one schema in oneOf"},
+		},
+		{
+			name:   "additionalProperties schema",
+			schema: `{"type": "object", "additionalProperties": {"type": "number"}}`,
+			value:  `{"a": 1, "b": "2"}`,
+			want:   []string{"$.b: expected type number, got string"},
+		},
+		{
+			name:   "unsupported keywords are ignored",
+			schema: `{"type": "string", "contentEncoding": "base64"}`,
+			value:  `"not base64!"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var schema map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.schema), &schema); err != nil {
+				t.Fatalf("bad schema: %v", err)
+			}
+			var value interface{}
+			if err := json.Unmarshal([]byte(tt.value), &value); err != nil {
+				t.Fatalf("bad value: %v", err)
+			}
+
+			got := validateJSONSchema(schema, value)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validateJSONSchema() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckExtractionSchema(t *testing.T) {
+	tests := []struct {
+		schema  string
+		wantErr bool
+	}{
+		{`{"type": "object", "properties": {"a": {"type": "string"}}}`, false},
+		{`{}`, true},
+		{`{"type": "array", "items": {}}`, true},
+		{`{"type": "object"}`, true},
+	}
+
+	for _, tt := range tests {
+		var schema map[string]interface{}
+		if err := json.Unmarshal([]byte(tt.schema), &schema); err != nil {
+			t.Fatalf("bad schema %s: %v", tt.schema, err)
+		}
+		if err := checkExtractionSchema(schema); (err != nil) != tt.wantErr {
+			t.Errorf("checkExtractionSchema(%s) error = %v, wantErr %v", tt.schema, err, tt.wantErr)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"database/sql"
 	"encoding/json"
@@ -9,8 +10,11 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -30,12 +34,14 @@ type User struct {
 }
 
 type Document struct {
-	ID          string    `json:"id" db:"id"`
-	UserID      string    `json:"user_id" db:"user_id"`
-	FileName    string    `json:"file_name" db:"file_name"`
-	StoragePath string    `json:"storage_path" db:"storage_path"`
-	UploadedAt  time.Time `json:"uploaded_at" db:"uploaded_at"`
-	Size        int64     `json:"size" db:"size"`
+	ID             string    `json:"id" db:"id"`
+	UserID         string    `json:"user_id" db:"user_id"`
+	FileName       string    `json:"file_name" db:"file_name"`
+	StoragePath    string    `json:"storage_path" db:"storage_path"`
+	UploadedAt     time.Time `json:"uploaded_at" db:"uploaded_at"`
+	Size           int64     `json:"size" db:"size"`
+	Collection     string    `json:"collection,omitempty" db:"collection"`
+	PromptTemplate string    `json:"prompt_template,omitempty" db:"prompt_template"`
 }
 
 type DocumentChunk struct {
@@ -43,6 +49,7 @@ type DocumentChunk struct {
 	DocumentID string    `json:"document_id" db:"document_id"`
 	ChunkIndex int       `json:"chunk_index" db:"chunk_index"`
 	Content    string    `json:"content" db:"content"`
+	PageNumber int       `json:"page_number,omitempty" db:"page_number"`
 	Embedding  *string   `json:"embedding,omitempty" db:"embedding"`
 	CreatedAt  time.Time `json:"created_at" db:"created_at"`
 }
@@ -54,17 +61,32 @@ type ChatMessage struct {
 	MessageType    string    `json:"message_type" db:"message_type"`
 	MessageContent string    `json:"message_content" db:"message_content"`
 	Timestamp      time.Time `json:"timestamp" db:"timestamp"`
+	PromptTemplate string    `json:"prompt_template,omitempty" db:"prompt_template"`
+	Model          string    `json:"model,omitempty" db:"model"`
+	Cancelled      bool      `json:"cancelled,omitempty" db:"cancelled"`
+
+	// The question a bot message answers
+	ParentID string `json:"parent_id,omitempty" db:"parent_id"`
+
+	// Client-supplied ID used to de-duplicate retried saves
+	ClientMessageID string `json:"client_message_id,omitempty" db:"client_message_id"`
+
+	// Sequence number of the conversation frame that carried the message
+	Seq int64 `json:"seq,omitempty" db:"seq"`
 }
 
 // Request/Response structures
 type UploadRequest struct {
-	UserID string `form:"user_id" binding:"required"`
-	Email  string `form:"email" binding:"required"`
+	UserID     string `form:"user_id" binding:"required"`
+	Email      string `form:"email" binding:"required"`
+	Collection string `form:"collection"`
+	// Prompt template preset for queries on this document
+	PromptTemplate string `form:"prompt_template"`
 }
 
 type UploadResponse struct {
 	Success    bool     `json:"success"`
-	Message    string  ` json:"message"`
+	Message    string   ` json:"message"`
 	DocumentID string   `json:"document_id,omitempty"`
 	Document   Document `json:"document,omitempty"`
 }
@@ -78,15 +100,29 @@ type LLMRequest struct {
 	DocumentID string `json:"document_id" binding:"required"`
 	Query      string `json:"query" binding:"required"`
 	UserID     string `json:"user_id,omitempty"`
+
+	// Query pipeline toggles; unset means the deployment default
+	Rewrite *bool `json:"rewrite,omitempty"`
+	Expand  *bool `json:"expand,omitempty"`
+
+	// Return the assembled prompt and context report with the answer
+	Debug bool `json:"debug,omitempty"`
+
+	// Prompt template to use instead of the document's, and settings
+	// (e.g. language, tone) available to the template
+	Template string            `json:"template,omitempty"`
+	Settings map[string]string `json:"settings,omitempty"`
 }
 
 type LLMResponse struct {
-	Success bool   `json:"success"`
-	Answer  string `json:"answer,omitempty"`
-	Error   string `json:"error,omitempty"`
+	Success bool        `json:"success"`
+	Answer  string      `json:"answer,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Debug   *QueryDebug `json:"debug,omitempty"`
 }
 
-// WebSocket message types
+// WebSocket message envelopes. Message types, frame types and error codes
+// are listed in protocol.go.
 type WSMessage struct {
 	Type       string `json:"type"`
 	Content    string `json:"content"`
@@ -94,43 +130,148 @@ type WSMessage struct {
 	UserID     string `json:"userId"`
 	Timestamp  string `json:"timestamp"`
 	ID         string `json:"id,omitempty"`
+
+	// Identifies a query so that it can be cancelled; set on query and
+	// cancel messages
+	RequestID string `json:"requestId,omitempty"`
+
+	// Query pipeline toggles; unset means the deployment default
+	Rewrite *bool `json:"rewrite,omitempty"`
+	Expand  *bool `json:"expand,omitempty"`
+
+	// Return the assembled prompt and context report with the answer
+	Debug bool `json:"debug,omitempty"`
+
+	// Prompt template to use instead of the document's, and settings
+	// (e.g. language, tone) available to the template
+	Template string            `json:"template,omitempty"`
+	Settings map[string]string `json:"settings,omitempty"`
+
+	// Feedback on a bot message: rating (up or down) and category, with the
+	// free-text reason in Content
+	MessageID string `json:"messageId,omitempty"`
+	Rating    string `json:"rating,omitempty"`
+	Category  string `json:"category,omitempty"`
 }
 
 type WSResponse struct {
-	Type      string `json:"type"`
-	Content   string `json:"content"`
-	ID        string `json:"id"`
-	Timestamp string `json:"timestamp"`
+	Type      string      `json:"type"`
+	Content   string      `json:"content"`
+	ID        string      `json:"id"`
+	Seq       int64       `json:"seq,omitempty"`
+	RequestID string      `json:"requestId,omitempty"`
+	Code      string      `json:"code,omitempty"`
+	Timestamp string      `json:"timestamp"`
+	Debug     *QueryDebug `json:"debug,omitempty"`
+
+	// Suggested questions, pushed when generation for the document finishes
+	Suggestions []string `json:"suggestions,omitempty"`
+
+	// Room events: a chat message from another connection, the users viewing
+	// the document, and the user a typing indicator is for
+	Message *ChatMessage `json:"message,omitempty"`
+	Users   []string     `json:"users,omitempty"`
+	UserID  string       `json:"userId,omitempty"`
 }
 
 // WebSocket upgrader
 var upgrader = websocket.Upgrader{
+	Subprotocols: wsProtocols,
 	CheckOrigin: func(r *http.Request) bool {
-		// Allow connections from any origin (configure appropriately for production)
-		return true
+		return originPolicy.AllowWebSocket(r)
 	},
 }
 
 // WebSocket client structure
 type Client struct {
+	id         string
 	conn       *websocket.Conn
 	send       chan WSResponse
 	documentID string
 	userID     string
+	protocol   string
+
+	// Cancelled when the connection closes
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Close frame payload written when the send channel is closed; an empty
+	// close frame if unset
+	closeMessage []byte
+
+	// Last conversation frame the client saw before reconnecting, and the
+	// stored messages after it in case the hub's buffer doesn't reach back
+	lastSeq int64
+	stored  []WSResponse
 }
 
-// Hub maintains the set of active clients
+// Hub maintains the set of active clients, grouped into one room per
+// document. Only the hub goroutine (run) touches the clients and rooms maps
+// or writes to and closes a client's send channel; everything else goes
+// through the hub's channels.
 type Hub struct {
 	clients    map[*Client]bool
+	rooms      map[string]map[*Client]bool
 	register   chan *Client
 	unregister chan *Client
+	broadcast  chan DocumentEvent
+	deliver    chan Delivery
+	backplane  Backplane
+
+	// Rooms whose membership changed since presence was last announced
+	changed map[string]bool
+
+	// Rooms whose members on this instance are to be published to the other
+	// instances, and whether to ask for theirs in return
+	membership map[string]bool
+
+	// Members of each room on other instances, by instance ID
+	remote          map[string]map[string]*remotePresence
+	presenceVersion int64
+
+	// Recent frames of each conversation, for replay on reconnect
+	history map[string]*conversationLog
+
+	// Signalled on shutdown; every client is then disconnected with a
+	// "server restarting" close frame, including ones registering later
+	quit    chan struct{}
+	closing bool
+}
+
+// Delivery is a message for one client
+type Delivery struct {
+	Client   *Client
+	Response WSResponse
+}
+
+// DocumentEvent is a message for the clients connected to a document: only
+// one user's connections if UserID is set (a conversation frame), and not a
+// user's connections if ExceptUser is set. Events cross instances through
+// the backplane, so clients are referred to by user. An event with Presence
+// set updates another instance's room members instead of carrying a frame,
+// and one with Evict set disconnects UserID's clients of the document.
+type DocumentEvent struct {
+	DocumentID string          `json:"documentId"`
+	UserID     string          `json:"userId,omitempty"`
+	ExceptUser string          `json:"exceptUser,omitempty"`
+	Response   WSResponse      `json:"response"`
+	Presence   *PresenceUpdate `json:"presence,omitempty"`
+	Evict      bool            `json:"evict,omitempty"`
 }
 
 // Global hub instance
 var hub = &Hub{
 	clients:    make(map[*Client]bool),
+	rooms:      make(map[string]map[*Client]bool),
+	changed:    make(map[string]bool),
+	membership: make(map[string]bool),
+	remote:     make(map[string]map[string]*remotePresence),
+	history:    make(map[string]*conversationLog),
+	quit:       make(chan struct{}),
 	register:   make(chan *Client),
 	unregister: make(chan *Client),
+	broadcast:  make(chan DocumentEvent, 256),
+	deliver:    make(chan Delivery, 256),
 }
 
 // Database connection
@@ -139,13 +280,7 @@ var db *sql.DB
 // Initialize database connection
 func initDB() error {
 	var err error
-	// Update with your database connection string
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		dbURL = os.Getenv("DB_URL")
-	}
-
-	db, err = sql.Open("postgres", dbURL)
+	db, err = sql.Open("postgres", cfg.DatabaseURL)
 	if err != nil {
 		return fmt.Errorf("failed to connect to database: %v", err)
 	}
@@ -188,15 +323,27 @@ func createOrGetUser(ctx context.Context, userID, email string) (*User, error) {
 	return user, nil
 }
 
-// Extract text from PDF
-func extractTextFromPDF(filePath string) (string, error) {
+// Text extracted from a single page of a document
+type PageText struct {
+	PageNumber int
+	Text       string
+}
+
+// A chunk of text ready to be stored, with the page it came from
+type TextChunk struct {
+	Content    string
+	PageNumber int
+}
+
+// Extract text from PDF, page by page
+func extractTextFromPDF(filePath string) ([]PageText, error) {
 	file, reader, err := pdf.Open(filePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to open PDF: %v", err)
+		return nil, fmt.Errorf("failed to open PDF: %v", err)
 	}
 	defer file.Close()
 
-	var text strings.Builder
+	var pages []PageText
 	totalPages := reader.NumPage()
 
 	for pageIndex := 1; pageIndex <= totalPages; pageIndex++ {
@@ -214,20 +361,27 @@ func extractTextFromPDF(filePath string) (string, error) {
 			continue
 		}
 
-		text.WriteString(pageText)
-		text.WriteString("\n\n")
+		pages = append(pages, PageText{PageNumber: pageIndex, Text: pageText})
 	}
 
-	return text.String(), nil
+	return pages, nil
 }
 
-// Extract text from text file
-func extractTextFromFile(filePath string) (string, error) {
+// Extract text from text file. Plain text has no pages, so it is all page 1.
+func extractTextFromFile(filePath string) ([]PageText, error) {
 	content, err := os.ReadFile(filePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to read file: %v", err)
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+	return []PageText{{PageNumber: 1, Text: string(content)}}, nil
+}
+
+// Extract text from a PDF or plain-text file
+func extractText(filePath string) ([]PageText, error) {
+	if strings.ToLower(filepath.Ext(filePath)) == ".pdf" {
+		return extractTextFromPDF(filePath)
 	}
-	return string(content), nil
+	return extractTextFromFile(filePath)
 }
 
 // Split text into chunks
@@ -269,31 +423,58 @@ func splitTextIntoChunks(text string, maxChunkSize int) []string {
 	return chunks
 }
 
+// Split each page into chunks. Chunks never span pages so that every chunk
+// can be cited by page number.
+func splitPagesIntoChunks(pages []PageText, maxChunkSize int) []TextChunk {
+	var chunks []TextChunk
+	for _, page := range pages {
+		for _, content := range splitTextIntoChunks(page.Text, maxChunkSize) {
+			chunks = append(chunks, TextChunk{Content: content, PageNumber: page.PageNumber})
+		}
+	}
+	return chunks
+}
+
 // Save document to database
-func saveDocument(ctx context.Context, userID, fileName, storagePath string, size int64) (*Document, error) {
+func saveDocument(ctx context.Context, userID, fileName, storagePath string, size int64, collection, promptTemplate string) (*Document, error) {
 	documentID := uuid.New().String()
 	now := time.Now()
 
 	_, err := db.ExecContext(ctx,
-		"INSERT INTO documents (id, user_id, file_name, storage_path, uploaded_at, size) VALUES ($1, $2, $3, $4, $5, $6)",
-		documentID, userID, fileName, storagePath, now, size)
+		"INSERT INTO documents (id, user_id, file_name, storage_path, uploaded_at, size, collection, prompt_template) VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''))",
+		documentID, userID, fileName, storagePath, now, size, collection, promptTemplate)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to save document: %v", err)
 	}
 
 	return &Document{
-		ID:          documentID,
-		UserID:      userID,
-		FileName:    fileName,
-		StoragePath: storagePath,
-		UploadedAt:  now,
-		Size:        size,
+		ID:             documentID,
+		UserID:         userID,
+		FileName:       fileName,
+		StoragePath:    storagePath,
+		UploadedAt:     now,
+		Size:           size,
+		Collection:     collection,
+		PromptTemplate: promptTemplate,
 	}, nil
 }
 
 // Save document chunks to database
-func saveDocumentChunks(ctx context.Context, documentID string, chunks []string) error {
+func saveDocumentChunks(ctx context.Context, documentID string, chunks []TextChunk) error {
+	texts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		texts[i] = chunk.Content
+	}
+
+	// Chunks are still saved without embeddings if the embedding API fails;
+	// retrieval then falls back to keyword search.
+	embeddings, err := provider.Embed(ctx, texts)
+	if err != nil {
+		log.Printf("Error embedding chunks for document %s: %v", documentID, err)
+		embeddings = nil
+	}
+
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %v", err)
@@ -302,9 +483,22 @@ func saveDocumentChunks(ctx context.Context, documentID string, chunks []string)
 
 	for i, chunk := range chunks {
 		chunkID := uuid.New().String()
-		_, err := tx.ExecContext(ctx,
-			"INSERT INTO document_chunks (id, document_id, chunk_index, content, created_at) VALUES ($1, $2, $3, $4, $5)",
-			chunkID, documentID, i, chunk, time.Now())
+
+		var err error
+		switch {
+		case embeddings == nil:
+			_, err = tx.ExecContext(ctx,
+				"INSERT INTO document_chunks (id, document_id, chunk_index, content, page_number, created_at) VALUES ($1, $2, $3, $4, $5, $6)",
+				chunkID, documentID, i, chunk.Content, chunk.PageNumber, time.Now())
+		case pgvectorEnabled:
+			_, err = tx.ExecContext(ctx,
+				"INSERT INTO document_chunks (id, document_id, chunk_index, content, page_number, embedding_vector, created_at) VALUES ($1, $2, $3, $4, $5, $6::vector, $7)",
+				chunkID, documentID, i, chunk.Content, chunk.PageNumber, formatVector(embeddings[i]), time.Now())
+		default:
+			_, err = tx.ExecContext(ctx,
+				"INSERT INTO document_chunks (id, document_id, chunk_index, content, page_number, embedding, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+				chunkID, documentID, i, chunk.Content, chunk.PageNumber, encodeEmbedding(embeddings[i]), time.Now())
+		}
 
 		if err != nil {
 			return fmt.Errorf("failed to save chunk %d: %v", i, err)
@@ -316,20 +510,188 @@ func saveDocumentChunks(ctx context.Context, documentID string, chunks []string)
 
 // Run the hub
 func (h *Hub) run() {
+	prune := time.NewTicker(time.Minute)
+	defer prune.Stop()
+
 	for {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
+			if h.rooms[client.documentID] == nil {
+				h.rooms[client.documentID] = make(map[*Client]bool)
+				// First member here: ask the other instances who they have
+				h.membershipChanged(client.documentID, true)
+			}
+			h.rooms[client.documentID][client] = true
+			h.changed[client.documentID] = true
+			h.membershipChanged(client.documentID, false)
 			log.Printf("Client registered. Total clients: %d", len(h.clients))
 
+			h.send(client, WSResponse{
+				Type:      wsReady,
+				Content:   client.protocol,
+				ID:        uuid.New().String(),
+				Timestamp: time.Now().Format(time.RFC3339),
+			})
+			h.replay(client)
+			if h.closing {
+				h.closeRestarting(client)
+			}
+
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+				h.remove(client)
 				log.Printf("Client unregistered. Total clients: %d", len(h.clients))
 			}
+
+		case delivery := <-h.deliver:
+			if _, ok := h.clients[delivery.Client]; ok {
+				h.send(delivery.Client, delivery.Response)
+			}
+
+		case event := <-h.broadcast:
+			if event.Presence != nil {
+				h.receivePresence(event.DocumentID, *event.Presence)
+				break
+			}
+			if event.Evict {
+				for client := range h.rooms[event.DocumentID] {
+					if client.userID == event.UserID {
+						h.closeRevoked(client)
+					}
+				}
+				break
+			}
+			// Unsequenced frames, such as chunks, aren't kept for replay
+			if event.UserID != "" && event.Response.Seq != 0 {
+				key := conversationKey(event.DocumentID, event.UserID)
+				if h.history[key] == nil {
+					h.history[key] = &conversationLog{since: event.Response.Seq - 1}
+				}
+				h.history[key].add(event.Response)
+			}
+			for client := range h.rooms[event.DocumentID] {
+				if event.UserID != "" && client.userID != event.UserID {
+					continue
+				}
+				if event.ExceptUser != "" && client.userID == event.ExceptUser {
+					continue
+				}
+				h.send(client, event.Response)
+			}
+
+		case <-prune.C:
+			h.pruneHistory()
+			h.refreshPresence()
+
+		case <-h.quit:
+			h.closing = true
+			for client := range h.clients {
+				h.closeRestarting(client)
+			}
+			log.Printf("Closed all WebSocket connections for shutdown")
+		}
+
+		// Announcing presence can evict slow clients, which changes the
+		// room again, so loop until nothing is left to announce
+		for len(h.changed) > 0 {
+			for documentID := range h.changed {
+				delete(h.changed, documentID)
+				h.announcePresence(documentID)
+			}
+		}
+		for documentID, request := range h.membership {
+			delete(h.membership, documentID)
+			h.publishPresence(documentID, request)
+		}
+	}
+}
+
+// Queue a message for a registered client, evicting the client if its
+// buffer is full. Must only be called from run.
+func (h *Hub) send(client *Client, response WSResponse) {
+	select {
+	case client.send <- response:
+	default:
+		h.remove(client)
+		log.Printf("Evicted slow client. Total clients: %d", len(h.clients))
+	}
+}
+
+// Remove a client, stopping its write pump. Must only be called from run.
+func (h *Hub) remove(client *Client) {
+	delete(h.clients, client)
+	if room := h.rooms[client.documentID]; room != nil {
+		delete(room, client)
+		if len(room) == 0 {
+			delete(h.rooms, client.documentID)
 		}
 	}
+	h.changed[client.documentID] = true
+	h.membershipChanged(client.documentID, false)
+	client.cancel()
+	close(client.send)
+}
+
+// Disconnect a client with a "server restarting" close frame, so it knows
+// to reconnect. Must only be called from run.
+func (h *Hub) closeRestarting(client *Client) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	client.closeMessage = websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting")
+	h.remove(client)
+}
+
+// Disconnect a client whose access to its document was removed, with a
+// "policy violation" close frame so it knows not to reconnect. Must only be
+// called from run.
+func (h *Hub) closeRevoked(client *Client) {
+	client.closeMessage = websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "access revoked")
+	h.remove(client)
+}
+
+// Disconnect a user's clients of a document on every instance
+func (h *Hub) evictUser(documentID, userID string) {
+	h.publish(DocumentEvent{DocumentID: documentID, UserID: userID, Evict: true})
+}
+
+// Disconnect every client for shutdown
+func (h *Hub) closeAll() {
+	h.quit <- struct{}{}
+}
+
+// Send a message to every client connected to a document, on every instance
+func (h *Hub) broadcastToDocument(documentID string, response WSResponse) {
+	h.publish(DocumentEvent{DocumentID: documentID, Response: response})
+}
+
+// Send a message to the other users in a client's room. The client's own
+// conversation gets its frames through sendToConversation.
+func (h *Hub) broadcastToOthers(client *Client, response WSResponse) {
+	h.publish(DocumentEvent{DocumentID: client.documentID, ExceptUser: client.userID, Response: response})
+}
+
+// Publish an event on the backplane, falling back to this instance's
+// clients if there is none or publishing fails
+func (h *Hub) publish(event DocumentEvent) {
+	if h.backplane == nil {
+		h.broadcast <- event
+		return
+	}
+	if err := h.backplane.Publish(context.Background(), event); err != nil {
+		log.Printf("Error publishing hub event: %v", err)
+		h.broadcast <- event
+	}
+}
+
+// Connect the hub to a backplane. Events received from it are delivered to
+// the clients of this instance.
+func (h *Hub) useBackplane(ctx context.Context, backplane Backplane) error {
+	h.backplane = backplane
+	return backplane.Start(ctx, func(event DocumentEvent) {
+		h.broadcast <- event
+	})
 }
 
 // Handle WebSocket connections
@@ -345,10 +707,8 @@ func handleWebSocket(c *gin.Context) {
 		return
 	}
 
-	// Verify document exists and user has access
-	var docExists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM documents WHERE id = $1 AND user_id = $2)",
-		documentID, userID).Scan(&docExists)
+	// Verify document exists and the user owns it or it is shared with them
+	hasAccess, err := canAccessDocument(c.Request.Context(), documentID, userID)
 	if err != nil {
 		log.Printf("Error verifying document access: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -357,14 +717,50 @@ func handleWebSocket(c *gin.Context) {
 		return
 	}
 
-	if !docExists {
+	if !hasAccess {
 		c.JSON(http.StatusNotFound, gin.H{
 			"error": "Document not found or access denied",
 		})
 		return
 	}
 
-	// Upgrade HTTP connection to WebSocket
+	if draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Server is restarting",
+		})
+		return
+	}
+
+	protocol, err := negotiateProtocol(c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// A reconnecting client passes the sequence number of the last
+	// conversation frame it saw, and is sent what it missed
+	var lastSeq int64
+	var stored []WSResponse
+	if value := c.Query("lastSeq"); value != "" {
+		lastSeq, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || lastSeq < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "lastSeq must be a non-negative integer",
+			})
+			return
+		}
+	}
+	if lastSeq > 0 {
+		stored, err = loadReplay(c.Request.Context(), documentID, userID, lastSeq)
+		if err != nil {
+			log.Printf("Error loading missed messages: %v", err)
+		}
+	}
+
+	// Upgrade HTTP connection to WebSocket. The upgrader echoes the
+	// negotiated subprotocol when the client offered one.
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Printf("Failed to upgrade connection: %v", err)
@@ -372,14 +768,23 @@ func handleWebSocket(c *gin.Context) {
 	}
 
 	// Create client
+	ctx, cancel := context.WithCancel(context.Background())
 	client := &Client{
+		id:         uuid.New().String(),
 		conn:       conn,
 		send:       make(chan WSResponse, 256),
 		documentID: documentID,
 		userID:     userID,
+		protocol:   protocol,
+		ctx:        ctx,
+		cancel:     cancel,
+		lastSeq:    lastSeq,
+		stored:     stored,
 	}
 
-	// Register client
+	// Register client; the hub sends the ready frame, replays missed frames
+	// and announces presence
+	joinConversation(conversationKey(documentID, userID))
 	hub.register <- client
 
 	// Start goroutines for reading and writing
@@ -390,6 +795,11 @@ func handleWebSocket(c *gin.Context) {
 // Read messages from WebSocket
 func (c *Client) readPump() {
 	defer func() {
+		// Stop sending to this connection. The conversation's in-flight
+		// queries keep running for a while so a reconnecting client can
+		// still get the answer.
+		c.cancel()
+		leaveConversation(conversationKey(c.documentID, c.userID))
 		hub.unregister <- c
 		c.conn.Close()
 	}()
@@ -402,8 +812,7 @@ func (c *Client) readPump() {
 	})
 
 	for {
-		var msg WSMessage
-		err := c.conn.ReadJSON(&msg)
+		_, data, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
@@ -411,14 +820,62 @@ func (c *Client) readPump() {
 			break
 		}
 
+		var msg WSMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.sendError("", wsErrBadMessage, "Message is not valid JSON: "+err.Error())
+			continue
+		}
+
 		log.Printf("Received WebSocket message: %+v", msg)
 
+		if code, err := validateWSMessage(msg); err != nil {
+			c.sendError(msg.RequestID, code, err.Error())
+			continue
+		}
+
+		// Acknowledge receipt, echoing the client's message ID
+		if msg.ID != "" {
+			c.sendResponse(WSResponse{
+				Type:      wsAck,
+				ID:        msg.ID,
+				RequestID: msg.RequestID,
+				Timestamp: time.Now().Format(time.RFC3339),
+			})
+		}
+
 		// Handle different message types
 		switch msg.Type {
-		case "query":
-			go c.handleQuery(msg)
-		default:
-			log.Printf("Unknown message type: %s", msg.Type)
+		case wsQuery:
+			requestID := msg.RequestID
+			if requestID == "" {
+				requestID = uuid.New().String()
+			}
+			if draining.Load() {
+				c.sendError(requestID, wsErrUnavailable, "Server is restarting")
+				continue
+			}
+			key := conversationKey(c.documentID, c.userID)
+			ctx, query := startQuery(key, requestID)
+			inflightQueries.Add(1)
+			go func() {
+				defer inflightQueries.Done()
+				defer finishQuery(key, requestID, query)
+				c.handleQuery(ctx, requestID, msg)
+			}()
+		case wsCancel:
+			if !cancelQuery(conversationKey(c.documentID, c.userID), msg.RequestID) {
+				c.sendError(msg.RequestID, wsErrUnknownRequest, "No query in progress with this request ID")
+			}
+		case wsFeedback:
+			go c.handleFeedback(msg)
+		case wsTyping:
+			hub.broadcastToOthers(c, WSResponse{
+				Type:      wsTyping,
+				Content:   msg.Content,
+				ID:        uuid.New().String(),
+				UserID:    c.userID,
+				Timestamp: time.Now().Format(time.RFC3339),
+			})
 		}
 	}
 }
@@ -436,7 +893,7 @@ func (c *Client) writePump() {
 		case message, ok := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage)
 				return
 			}
 
@@ -454,95 +911,280 @@ func (c *Client) writePump() {
 	}
 }
 
-// Handle query messages
-func (c *Client) handleQuery(msg WSMessage) {
-	// Fetch document content
-	rows, err := db.Query("SELECT content FROM document_chunks WHERE document_id = $1 ORDER BY chunk_index", c.documentID)
+// Handle query messages. The answer is streamed as chunk frames followed by
+// a response frame, or a cancelled frame if the query is cancelled first.
+func (c *Client) handleQuery(ctx context.Context, requestID string, msg WSMessage) {
+	question := ChatMessage{
+		ID:              uuid.New().String(),
+		DocumentID:      c.documentID,
+		UserID:          c.userID,
+		MessageType:     "user",
+		MessageContent:  msg.Content,
+		Timestamp:       time.Now(),
+		ClientMessageID: msg.ID,
+		Seq:             c.nextSeq(),
+	}
+
+	// Save the question before answering it. A retried query gets the ID of
+	// the question saved the first time.
+	savedID, err := insertChatMessage(db, question)
 	if err != nil {
-		c.sendError("Failed to fetch document content")
+		log.Printf("Error saving user message: %v", err)
+		c.sendQueryError(requestID, wsErrInternal, "Failed to save message")
 		return
 	}
-	defer rows.Close()
 
-	var contentBuilder strings.Builder
-	for rows.Next() {
-		var chunk string
-		if err := rows.Scan(&chunk); err != nil {
-			continue
+	if savedID != question.ID {
+		question.ID = savedID
+		// Answered already: send that answer instead of generating another
+		reply, err := findAnswer(ctx, question.ID)
+		if err != nil {
+			log.Printf("Error looking up answer to %s: %v", question.ID, err)
+		} else if reply != nil {
+			c.sendToConversation(WSResponse{
+				Type:      wsResponse,
+				Content:   reply.MessageContent,
+				ID:        reply.ID,
+				RequestID: requestID,
+				Timestamp: time.Now().Format(time.RFC3339),
+			})
+			return
 		}
-		contentBuilder.WriteString(chunk + "\n\n")
+	} else {
+		// Show the question in the user's conversation and to the document's
+		// other users. A retried question has been shown already.
+		c.sendMessage(requestID, question)
 	}
 
-	content := contentBuilder.String()
-	if content == "" {
-		c.sendError("No content found for this document")
+	templateName, err := resolvePromptTemplate(ctx, c.documentID, msg.Template)
+	if ctx.Err() != nil {
+		c.sendCancelled(requestID, question, "", "")
 		return
 	}
-
-	// Limit content size
-	if len(content) > 24000 {
-		content = content[:24000]
+	if err != nil {
+		c.sendQueryError(requestID, wsErrInvalidRequest, err.Error())
+		return
 	}
 
-	// Create prompt for AI
-	prompt := fmt.Sprintf(`Based on the following document content, please answer the user's question accurately and concisely.
-
-Document Content:
-%s
+	// Fetch the chunks most relevant to the question
+	history := loadHistory(ctx, c.documentID, c.userID, msg.Content)
+	opts := resolveQueryOptions(msg.Rewrite, msg.Expand)
+	result, err := retrieveForQuery(ctx, c.documentID, msg.Content, history, opts)
+	if ctx.Err() != nil {
+		c.sendCancelled(requestID, question, "", "")
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving chunks: %v", err)
+		c.sendQueryError(requestID, wsErrRetrieval, "Failed to fetch document content")
+		return
+	}
 
-User Question: %s
+	if len(result.Chunks) == 0 {
+		c.sendQueryError(requestID, wsErrNoContent, "No content found for this document")
+		return
+	}
 
-Please provide a helpful and accurate answer based on the document content above.`, content, msg.Content)
+	// Create prompt for AI
+	prompt, err := buildAnswerPrompt(PromptRequest{
+		Template: templateName,
+		Question: msg.Content,
+		History:  history,
+		Settings: msg.Settings,
+		Chunks:   result.Chunks,
+	})
+	if err != nil {
+		log.Printf("Error building prompt: %v", err)
+		c.sendQueryError(requestID, wsErrInternal, "Failed to build prompt")
+		return
+	}
 
-	// Call Gemini API
-	answer, err := callGeminiAPI(prompt)
+	// Stream the answer
+	answer, err := provider.Stream(ctx, prompt.Text, func(text string) {
+		c.streamToConversation(WSResponse{
+			Type:      wsChunk,
+			Content:   text,
+			ID:        uuid.New().String(),
+			RequestID: requestID,
+			Timestamp: time.Now().Format(time.RFC3339),
+		})
+	})
+	if ctx.Err() != nil {
+		c.sendCancelled(requestID, question, answer, prompt.Template)
+		return
+	}
 	if err != nil {
-		log.Printf("Error calling Gemini API: %v", err)
-		c.sendError("Failed to get response from AI: " + err.Error())
+		log.Printf("Error calling %s: %v", provider.Model(), err)
+		c.sendQueryError(requestID, wsErrProvider, "Failed to get response from AI: "+err.Error())
 		return
 	}
 
-	// Save bot response to database
+	// Save the bot response as the answer to the question
 	responseID := uuid.New().String()
-	_, err = db.Exec(`
-		INSERT INTO chat_messages (id, document_id, user_id, message_type, message_content, timestamp)
-		VALUES ($1, $2, $3, $4, $5, $6)`,
-		responseID, c.documentID, c.userID, "bot", answer, time.Now())
-	if err != nil {
+	reply := ChatMessage{
+		ID:             responseID,
+		DocumentID:     c.documentID,
+		UserID:         c.userID,
+		MessageType:    "bot",
+		MessageContent: answer,
+		Timestamp:      time.Now(),
+		PromptTemplate: prompt.Template,
+		Model:          provider.Model(),
+		ParentID:       question.ID,
+		Seq:            c.nextSeq(),
+	}
+	if _, err := insertChatMessage(db, reply); err != nil {
 		log.Printf("Error saving bot message: %v", err)
 	}
 
+	hub.broadcastToOthers(c, messageFrame(requestID, reply))
+
 	// Send response
 	response := WSResponse{
-		Type:      "response",
+		Type:      wsResponse,
 		Content:   answer,
 		ID:        responseID,
+		Seq:       reply.Seq,
+		RequestID: requestID,
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
+	if msg.Debug {
+		response.Debug = newQueryDebug(result, prompt, answer)
+	}
 
-	select {
-	case c.send <- response:
-	default:
-		close(c.send)
-		delete(hub.clients, c)
+	c.sendToConversation(response)
+}
+
+// rowQuerier is satisfied by both *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Insert a chat message, or return the ID of the message already saved under
+// the same client message ID
+func insertChatMessage(q rowQuerier, msg ChatMessage) (string, error) {
+	var id string
+	err := q.QueryRow(`
+		INSERT INTO chat_messages (id, document_id, user_id, message_type, message_content, timestamp,
+			prompt_template, model, cancelled, parent_id, client_message_id, seq)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), $9, NULLIF($10, ''), NULLIF($11, ''), NULLIF($12, 0))
+		ON CONFLICT (user_id, client_message_id) WHERE client_message_id IS NOT NULL
+		DO UPDATE SET client_message_id = EXCLUDED.client_message_id
+		RETURNING id`,
+		msg.ID, msg.DocumentID, msg.UserID, msg.MessageType, msg.MessageContent, msg.Timestamp,
+		msg.PromptTemplate, msg.Model, msg.Cancelled, msg.ParentID, msg.ClientMessageID, msg.Seq).Scan(&id)
+	return id, err
+}
+
+// Fetch the completed answer to a saved question, or nil if it hasn't been
+// answered. Cancelled partial answers don't count.
+func findAnswer(ctx context.Context, questionID string) (*ChatMessage, error) {
+	var reply ChatMessage
+	err := db.QueryRowContext(ctx, `
+		SELECT id, message_content, timestamp
+		FROM chat_messages
+		WHERE parent_id = $1 AND message_type = 'bot' AND NOT cancelled
+		ORDER BY timestamp DESC
+		LIMIT 1`, questionID).Scan(&reply.ID, &reply.MessageContent, &reply.Timestamp)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to fetch answer: %v", err)
 	}
+	reply.ParentID = questionID
+	reply.MessageType = "bot"
+	return &reply, nil
+}
+
+// Report a cancelled query with the text streamed before it stopped. The
+// partial answer is saved when PERSIST_CANCELLED_ANSWERS is enabled.
+func (c *Client) sendCancelled(requestID string, question ChatMessage, partial, templateName string) {
+	responseID := uuid.New().String()
+	seq := c.nextSeq()
+
+	if partial != "" && cfg.PersistCancelledAnswers {
+		_, err := insertChatMessage(db, ChatMessage{
+			ID:             responseID,
+			DocumentID:     question.DocumentID,
+			UserID:         question.UserID,
+			MessageType:    "bot",
+			MessageContent: partial,
+			Timestamp:      time.Now(),
+			PromptTemplate: templateName,
+			Model:          provider.Model(),
+			Cancelled:      true,
+			ParentID:       question.ID,
+			Seq:            seq,
+		})
+		if err != nil {
+			log.Printf("Error saving cancelled answer: %v", err)
+		}
+	}
+
+	c.sendToConversation(WSResponse{
+		Type:      wsCancelled,
+		Content:   partial,
+		ID:        responseID,
+		Seq:       seq,
+		RequestID: requestID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+}
+
+// Frame showing a chat message. The message is copied so the frame doesn't
+// change if the caller's copy does.
+func messageFrame(requestID string, msg ChatMessage) WSResponse {
+	return WSResponse{
+		Type:      wsMessage,
+		ID:        uuid.New().String(),
+		RequestID: requestID,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Message:   &msg,
+	}
+}
+
+// Show a chat message in the user's conversation and to the document's other
+// users. The conversation frame carries the message's sequence number.
+func (c *Client) sendMessage(requestID string, msg ChatMessage) {
+	frame := messageFrame(requestID, msg)
+	frame.Seq = msg.Seq
+	c.sendToConversation(frame)
+
+	msg.Seq = 0
+	hub.broadcastToOthers(c, messageFrame(requestID, msg))
+}
+
+// Report a failed query to the user's conversation
+func (c *Client) sendQueryError(requestID, code, errorMsg string) {
+	c.sendToConversation(WSResponse{
+		Type:      wsError,
+		Code:      code,
+		Content:   errorMsg,
+		ID:        uuid.New().String(),
+		RequestID: requestID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
 }
 
 // Send error message to client
-func (c *Client) sendError(errorMsg string) {
-	response := WSResponse{
-		Type:      "error",
+func (c *Client) sendError(requestID, code, errorMsg string) {
+	c.sendResponse(WSResponse{
+		Type:      wsError,
+		Code:      code,
 		Content:   errorMsg,
 		ID:        uuid.New().String(),
+		RequestID: requestID,
 		Timestamp: time.Now().Format(time.RFC3339),
-	}
+	})
+}
 
-	select {
-	case c.send <- response:
-	default:
-		close(c.send)
-		delete(hub.clients, c)
+// Queue a message for the client through the hub. Nothing is sent once the
+// connection has closed or the client has been evicted.
+func (c *Client) sendResponse(response WSResponse) {
+	if c.ctx.Err() != nil {
+		return
 	}
+	hub.deliver <- Delivery{Client: c, Response: response}
 }
 
 // Upload handler
@@ -578,6 +1220,14 @@ func uploadHandler(c *gin.Context) {
 		return
 	}
 
+	if _, ok := promptTemplates[req.PromptTemplate]; req.PromptTemplate != "" && !ok {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Unknown prompt template %q", req.PromptTemplate),
+		})
+		return
+	}
+
 	// Create uploads directory if it doesn't exist
 	uploadsDir := "uploads"
 	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
@@ -622,13 +1272,7 @@ func uploadHandler(c *gin.Context) {
 	}
 
 	// Extract text from file
-	var extractedText string
-	if ext == ".pdf" {
-		extractedText, err = extractTextFromPDF(filePath)
-	} else {
-		extractedText, err = extractTextFromFile(filePath)
-	}
-
+	pages, err := extractText(filePath)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{
 			Success: false,
@@ -637,7 +1281,10 @@ func uploadHandler(c *gin.Context) {
 		return
 	}
 
-	if strings.TrimSpace(extractedText) == "" {
+	// Split text into chunks
+	chunks := splitPagesIntoChunks(pages, cfg.ChunkSize)
+
+	if len(chunks) == 0 {
 		c.JSON(http.StatusBadRequest, ErrorResponse{
 			Success: false,
 			Error:   "No text content found in the file",
@@ -646,7 +1293,7 @@ func uploadHandler(c *gin.Context) {
 	}
 
 	// Save document to database
-	document, err := saveDocument(ctx, req.UserID, fileName, filePath, header.Size)
+	document, err := saveDocument(ctx, req.UserID, fileName, filePath, header.Size, req.Collection, req.PromptTemplate)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{
 			Success: false,
@@ -655,9 +1302,6 @@ func uploadHandler(c *gin.Context) {
 		return
 	}
 
-	// Split text into chunks
-	chunks := splitTextIntoChunks(extractedText, 1000)
-
 	// Save chunks to database
 	err = saveDocumentChunks(ctx, document.ID, chunks)
 	if err != nil {
@@ -668,6 +1312,18 @@ func uploadHandler(c *gin.Context) {
 		return
 	}
 
+	if cfg.AutoSuggest {
+		worker.Enqueue("suggest "+document.ID, func(ctx context.Context) {
+			autoSuggest(ctx, document.ID)
+		})
+	}
+
+	if cfg.AutoSummarize {
+		worker.Enqueue("summarize "+document.ID, func(ctx context.Context) {
+			autoSummarize(ctx, document.ID)
+		})
+	}
+
 	c.JSON(http.StatusOK, UploadResponse{
 		Success:    true,
 		Message:    fmt.Sprintf("Document uploaded successfully. Extracted %d chunks of text.", len(chunks)),
@@ -687,7 +1343,7 @@ func getUserDocuments(c *gin.Context) {
 		return
 	}
 
-	rows, err := db.Query("SELECT id, user_id, file_name, storage_path, uploaded_at, size FROM documents WHERE user_id = $1 ORDER BY uploaded_at DESC", userID)
+	rows, err := db.Query("SELECT id, user_id, file_name, storage_path, uploaded_at, size, COALESCE(collection, ''), COALESCE(prompt_template, '') FROM documents WHERE user_id = $1 ORDER BY uploaded_at DESC", userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{
 			Success: false,
@@ -700,7 +1356,7 @@ func getUserDocuments(c *gin.Context) {
 	var documents []Document
 	for rows.Next() {
 		var doc Document
-		err := rows.Scan(&doc.ID, &doc.UserID, &doc.FileName, &doc.StoragePath, &doc.UploadedAt, &doc.Size)
+		err := rows.Scan(&doc.ID, &doc.UserID, &doc.FileName, &doc.StoragePath, &doc.UploadedAt, &doc.Size, &doc.Collection, &doc.PromptTemplate)
 		if err != nil {
 			log.Printf("Error scanning document: %v", err)
 			continue
@@ -725,7 +1381,7 @@ func getDocumentChunks(c *gin.Context) {
 		return
 	}
 
-	rows, err := db.Query("SELECT id, document_id, chunk_index, content, created_at FROM document_chunks WHERE document_id = $1 ORDER BY chunk_index", documentID)
+	rows, err := db.Query("SELECT id, document_id, chunk_index, content, COALESCE(page_number, 0), created_at FROM document_chunks WHERE document_id = $1 ORDER BY chunk_index", documentID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{
 			Success: false,
@@ -738,7 +1394,7 @@ func getDocumentChunks(c *gin.Context) {
 	var chunks []DocumentChunk
 	for rows.Next() {
 		var chunk DocumentChunk
-		err := rows.Scan(&chunk.ID, &chunk.DocumentID, &chunk.ChunkIndex, &chunk.Content, &chunk.CreatedAt)
+		err := rows.Scan(&chunk.ID, &chunk.DocumentID, &chunk.ChunkIndex, &chunk.Content, &chunk.PageNumber, &chunk.CreatedAt)
 		if err != nil {
 			log.Printf("Error scanning chunk: %v", err)
 			continue
@@ -765,10 +1421,10 @@ func getDocumentInfo(c *gin.Context) {
 
 	var doc Document
 	err := db.QueryRow(`
-		SELECT id, user_id, file_name, storage_path, uploaded_at, size
+		SELECT id, user_id, file_name, storage_path, uploaded_at, size, COALESCE(collection, ''), COALESCE(prompt_template, '')
 		FROM documents
 		WHERE id = $1`, documentID).
-		Scan(&doc.ID, &doc.UserID, &doc.FileName, &doc.StoragePath, &doc.UploadedAt, &doc.Size)
+		Scan(&doc.ID, &doc.UserID, &doc.FileName, &doc.StoragePath, &doc.UploadedAt, &doc.Size, &doc.Collection, &doc.PromptTemplate)
 
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, ErrorResponse{
@@ -804,7 +1460,7 @@ func getChatHistory(c *gin.Context) {
 	}
 
 	rows, err := db.Query(`
-		SELECT id, message_type, message_content, timestamp
+		SELECT id, message_type, message_content, timestamp, COALESCE(prompt_template, ''), COALESCE(model, ''), cancelled, COALESCE(parent_id, ''), COALESCE(seq, 0)
 		FROM chat_messages
 		WHERE document_id = $1 AND user_id = $2
 		ORDER BY timestamp ASC`, documentID, userID)
@@ -820,7 +1476,7 @@ func getChatHistory(c *gin.Context) {
 	var messages []ChatMessage
 	for rows.Next() {
 		var msg ChatMessage
-		err := rows.Scan(&msg.ID, &msg.MessageType, &msg.MessageContent, &msg.Timestamp)
+		err := rows.Scan(&msg.ID, &msg.MessageType, &msg.MessageContent, &msg.Timestamp, &msg.PromptTemplate, &msg.Model, &msg.Cancelled, &msg.ParentID, &msg.Seq)
 		if err != nil {
 			log.Printf("Error scanning message: %v", err)
 			continue
@@ -880,8 +1536,19 @@ func queryLLMHandler(c *gin.Context) {
 		return
 	}
 
-	// Fetch content chunks from DB
-	rows, err := db.Query("SELECT content FROM document_chunks WHERE document_id = $1 ORDER BY chunk_index", req.DocumentID)
+	templateName, err := resolvePromptTemplate(c.Request.Context(), req.DocumentID, req.Template)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, LLMResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// Fetch the chunks most relevant to the query
+	history := loadHistory(c.Request.Context(), req.DocumentID, req.UserID, req.Query)
+	opts := resolveQueryOptions(req.Rewrite, req.Expand)
+	result, err := retrieveForQuery(c.Request.Context(), req.DocumentID, req.Query, history, opts)
 	if err != nil {
 		log.Printf("Error fetching chunks: %v", err)
 		c.JSON(http.StatusInternalServerError, LLMResponse{
@@ -890,23 +1557,10 @@ func queryLLMHandler(c *gin.Context) {
 		})
 		return
 	}
-	defer rows.Close()
-
-	var contentBuilder strings.Builder
-	chunkCount := 0
-	for rows.Next() {
-		var chunk string
-		if err := rows.Scan(&chunk); err != nil {
-			log.Printf("Error scanning chunk: %v", err)
-			continue
-		}
-		contentBuilder.WriteString(chunk + "\n\n")
-		chunkCount++
-	}
 
-	log.Printf("Found %d chunks for document %s", chunkCount, req.DocumentID)
+	log.Printf("Found %d chunks for document %s", len(result.Chunks), req.DocumentID)
 
-	if chunkCount == 0 {
+	if len(result.Chunks) == 0 {
 		c.JSON(http.StatusNotFound, LLMResponse{
 			Success: false,
 			Error:   "No content found for this document",
@@ -914,24 +1568,25 @@ func queryLLMHandler(c *gin.Context) {
 		return
 	}
 
-	// Limit content size to avoid API limits
-	content := contentBuilder.String()
-	if len(content) > 24000 {
-		content = content[:24000]
-		log.Printf("Content truncated to 24000 characters")
+	// Build the prompt, limiting content size to avoid API limits
+	prompt, err := buildAnswerPrompt(PromptRequest{
+		Template: templateName,
+		Question: req.Query,
+		History:  history,
+		Settings: req.Settings,
+		Chunks:   result.Chunks,
+	})
+	if err != nil {
+		log.Printf("Error building prompt: %v", err)
+		c.JSON(http.StatusInternalServerError, LLMResponse{
+			Success: false,
+			Error:   "Failed to build prompt: " + err.Error(),
+		})
+		return
 	}
 
-	prompt := fmt.Sprintf(`Based on the following document content, please answer the user's question accurately and concisely.
-
-Document Content:
-%s
-
-User Question: %s
-
-Please provide a helpful and accurate answer based on the document content above.`, content, req.Query)
-
-	// Call Gemini API
-	answer, err := callGeminiAPI(prompt)
+	// Generate the answer
+	answer, err := provider.Generate(c.Request.Context(), prompt.Text)
 	if err != nil {
 		log.Printf("Error calling Gemini API: %v", err)
 		c.JSON(http.StatusInternalServerError, LLMResponse{
@@ -942,14 +1597,43 @@ Please provide a helpful and accurate answer based on the document content above
 	}
 
 	log.Printf("Successfully got response from Gemini API")
-	c.JSON(http.StatusOK, LLMResponse{
+	response := LLMResponse{
 		Success: true,
 		Answer:  answer,
-	})
+	}
+	if req.Debug {
+		response.Debug = newQueryDebug(result, prompt, answer)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// HTTP client for Gemini API calls, bounded by the configured timeout
+func geminiClient() *http.Client {
+	return &http.Client{Timeout: cfg.LLMTimeout}
 }
 
 // Separate function to call Gemini API
-func callGeminiAPI(prompt string) (string, error) {
+func callGeminiAPI(ctx context.Context, prompt string) (string, error) {
+	return callGeminiAPIWithConfig(ctx, prompt, map[string]interface{}{
+		"temperature":     0.7,
+		"maxOutputTokens": budgetForModel(cfg.LLMModel).OutputTokens,
+	})
+}
+
+// Call Gemini API asking for a JSON response. Used for internal pipeline
+// steps (reranking, query rewriting) that parse the model output.
+func callGeminiJSON(ctx context.Context, prompt string) (string, error) {
+	return callGeminiAPIWithConfig(ctx, prompt, map[string]interface{}{
+		"temperature":      0,
+		"maxOutputTokens":  2048,
+		"responseMimeType": "application/json",
+	})
+}
+
+// Call Gemini API with an explicit generation config. The request is
+// aborted when ctx is cancelled.
+func callGeminiAPIWithConfig(ctx context.Context, prompt string, generationConfig map[string]interface{}) (string, error) {
 	// Prepare request body
 	requestBody := map[string]interface{}{
 		"contents": []map[string]interface{}{
@@ -960,10 +1644,7 @@ func callGeminiAPI(prompt string) (string, error) {
 				"role": "user",
 			},
 		},
-		"generationConfig": map[string]interface{}{
-			"temperature":     0.7,
-			"maxOutputTokens": 2048,
-		},
+		"generationConfig": generationConfig,
 	}
 
 	jsonBody, err := json.Marshal(requestBody)
@@ -972,11 +1653,19 @@ func callGeminiAPI(prompt string) (string, error) {
 	}
 
 	// Make API call
-	apiKey := os.Getenv("API_KEY")
-	url := "https://generativelanguage.googleapis.com/v1beta/models/gemini-2.5-flash:generateContent?key=" + apiKey
+	url := "https://generativelanguage.googleapis.com/v1beta/models/" + cfg.LLMModel + ":generateContent?key=" + cfg.APIKey
 
-	resp, err := http.Post(url, "application/json", strings.NewReader(string(jsonBody)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(string(jsonBody)))
 	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := geminiClient().Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
 		return "", fmt.Errorf("failed to call Gemini API: %v", err)
 	}
 	defer resp.Body.Close()
@@ -1021,6 +1710,100 @@ func callGeminiAPI(prompt string) (string, error) {
 	return geminiResp.Candidates[0].Content.Parts[0].Text, nil
 }
 
+// Stream a Gemini answer, calling onChunk with each piece of text as it
+// arrives. The request is aborted when ctx is cancelled, in which case the
+// text received so far is returned with the context's error.
+func callGeminiStream(ctx context.Context, prompt string, onChunk func(string)) (string, error) {
+	requestBody := map[string]interface{}{
+		"contents": []map[string]interface{}{
+			{
+				"parts": []map[string]interface{}{
+					{"text": prompt},
+				},
+				"role": "user",
+			},
+		},
+		"generationConfig": map[string]interface{}{
+			"temperature":     0.7,
+			"maxOutputTokens": budgetForModel(cfg.LLMModel).OutputTokens,
+		},
+	}
+
+	jsonBody, err := json.Marshal(requestBody)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	url := "https://generativelanguage.googleapis.com/v1beta/models/" + cfg.LLMModel + ":streamGenerateContent?alt=sse&key=" + cfg.APIKey
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(string(jsonBody)))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := geminiClient().Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("failed to call Gemini API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("Gemini API returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	// Each server-sent event carries a partial GenerateContentResponse
+	var answer strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		var event struct {
+			Candidates []struct {
+				Content struct {
+					Parts []struct {
+						Text string `json:"text"`
+					} `json:"parts"`
+				} `json:"content"`
+			} `json:"candidates"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+			return answer.String(), fmt.Errorf("failed to parse stream event: %v", err)
+		}
+
+		for _, candidate := range event.Candidates {
+			for _, part := range candidate.Content.Parts {
+				if part.Text == "" {
+					continue
+				}
+				answer.WriteString(part.Text)
+				if onChunk != nil {
+					onChunk(part.Text)
+				}
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return answer.String(), ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return answer.String(), fmt.Errorf("failed to read stream: %v", err)
+	}
+	if answer.Len() == 0 {
+		return "", fmt.Errorf("no response generated")
+	}
+	return answer.String(), nil
+}
+
 // Save chat message handler
 func saveChatHandler(c *gin.Context) {
 	var msg ChatMessage
@@ -1032,11 +1815,27 @@ func saveChatHandler(c *gin.Context) {
 		return
 	}
 
-	// Save user message to database
-	_, err := db.Exec(`
-		INSERT INTO chat_messages (id, document_id, user_id, message_type, message_content, timestamp)
-		VALUES ($1, $2, $3, $4, $5, $6)`,
-		uuid.New().String(), msg.DocumentID, msg.UserID, msg.MessageType, msg.MessageContent, time.Now())
+	// Clients can only save their own questions; answers, their links to
+	// questions and sequence numbers are assigned by the server
+	if msg.MessageType != "" && msg.MessageType != "user" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "message_type must be user",
+		})
+		return
+	}
+	msg.MessageType = "user"
+	msg.ID = uuid.New().String()
+	msg.Timestamp = time.Now()
+	msg.Seq = 0
+	msg.ParentID = ""
+	msg.Cancelled = false
+	msg.Model = ""
+	msg.PromptTemplate = ""
+
+	// Save message to database. A message already saved under the same
+	// client message ID is not saved again.
+	id, err := insertChatMessage(db, msg)
 	if err != nil {
 		log.Printf("Error saving user message: %v", err)
 		c.JSON(http.StatusInternalServerError, ErrorResponse{
@@ -1046,7 +1845,29 @@ func saveChatHandler(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"success": true})
+	// The client message ID was used before; it must have been for this
+	// document
+	if id != msg.ID {
+		var documentID string
+		err := db.QueryRow("SELECT document_id FROM chat_messages WHERE id = $1", id).Scan(&documentID)
+		if err != nil {
+			log.Printf("Error fetching saved message %s: %v", id, err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{
+				Success: false,
+				Error:   "Failed to save chat message",
+			})
+			return
+		}
+		if documentID != msg.DocumentID {
+			c.JSON(http.StatusConflict, ErrorResponse{
+				Success: false,
+				Error:   "client_message_id is already used by a message on another document",
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "id": id})
 }
 
 // Health check
@@ -1058,32 +1879,116 @@ func healthCheck(c *gin.Context) {
 			"GET /health",
 			"POST /upload",
 			"GET /users/:userId/documents",
+			"GET /search",
 			"GET /documents/:documentId/chunks",
 			"POST /ask",
 			"GET /documents/:documentId/info",
 			"GET /documents/:documentId/chat",
+			"GET /documents/:documentId/shares",
+			"POST /documents/:documentId/shares",
+			"DELETE /documents/:documentId/shares/:userId",
+			"POST /documents/:documentId/retrieve",
+			"PUT /documents/:documentId/template",
+			"POST /documents/:documentId/summary",
+			"POST /documents/:documentId/extract",
+			"GET /documents/:documentId/extractions",
+			"GET /extractions/:extractionId",
+			"POST /extractions/:extractionId/rerun",
+			"GET /documents/:documentId/suggestions",
+			"POST /documents/:documentId/suggestions",
+			"POST /documents/:documentId/quiz",
+			"GET /documents/:documentId/quizzes",
+			"GET /quizzes/:quizId",
+			"GET /quizzes/:quizId/flashcards",
+			"POST /messages/:messageId/feedback",
+			"GET /feedback/report",
+			"POST /collections/:collection/extract",
+			"GET /batches/:batchId",
+			"GET /batches/:batchId/export",
+			"GET /prompt-templates",
 			"GET /ws",
 		},
 	})
 }
 
+// Connect to the database and load the pipeline settings shared by the
+// server and the eval command
+func initServices() error {
+	if err := initDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %v", err)
+	}
+
+	// Initialize the database schema
+	initSchema(db)
+
+	fusionWeights = loadFusionWeights()
+	reranker = newReranker(cfg.Reranker)
+	tokenizer = newTokenizer(cfg.Tokenizer)
+
+	var err error
+	provider, err = newProvider(cfg.LLMProvider)
+	if err != nil {
+		return err
+	}
+
+	promptTemplates, err = loadPromptTemplates(cfg.PromptTemplateDir)
+	if err != nil {
+		return fmt.Errorf("failed to load prompt templates: %v", err)
+	}
+	return nil
+}
+
 func main() {
-	// Initialize database
 	err := godotenv.Load()
 	if err != nil {
 		log.Println("Error loading .env file, will use environment variables from the system")
 	}
-	if err := initDB(); err != nil {
-		log.Fatal("Failed to initialize database:", err)
+
+	// Subcommands. eval reads the configuration from the environment and
+	// CONFIG_FILE only, since its flags are its own.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "eval":
+			if cfg, err = loadConfig("eval", nil); err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(runEval(os.Args[2:]))
+		case "config":
+			os.Exit(runConfig(os.Args[2:]))
+		}
 	}
-	defer db.Close()
 
-	// Initialize the database schema
-	initSchema(db)
+	cfg, err = loadConfig("docsy", os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := initServices(); err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
 
 	// Start the hub
+	backplane, err := newBackplane(cfg.HubBackplane)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := hub.useBackplane(context.Background(), backplane); err != nil {
+		log.Fatal("Failed to start hub backplane:", err)
+	}
+	defer backplane.Close()
 	go hub.run()
 
+	// Start the background worker. Jobs still running when shutdown gives up
+	// on them are cancelled.
+	workerCtx, cancelWorker := context.WithCancel(context.Background())
+	defer cancelWorker()
+	worker.Start(workerCtx, cfg.WorkerConcurrency)
+	go superviseBatches(workerCtx)
+
 	// Initialize Gin router
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
@@ -1092,13 +1997,10 @@ func main() {
 	r.Use(gin.Logger())
 	r.Use(gin.Recovery())
 
-	// Configure CORS
+	// Configure CORS. The same origin policy guards WebSocket upgrades.
+	originPolicy = loadOriginPolicy()
 	config := cors.DefaultConfig()
-	frontendURL := os.Getenv("FRONTEND_URL")
-	if frontendURL == "" {
-		frontendURL = "http://localhost:3000" // Default for local dev
-	}
-	config.AllowOrigins = []string{frontendURL, "http://localhost:3001", "http://localhost:8080", "https://docsy-nul446phu-himanshu-kumars-projects-f5ecd6b4.vercel.app", "https://docsy-xi.vercel.app"}
+	config.AllowOriginFunc = originPolicy.AllowCORS
 	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
 	config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization", "X-Requested-With"}
 	config.AllowCredentials = true
@@ -1108,9 +2010,32 @@ func main() {
 	r.GET("/health", healthCheck)
 	r.POST("/upload", uploadHandler)
 	r.GET("/users/:userId/documents", getUserDocuments)
+	r.GET("/search", searchDocumentsHandler)
 	r.GET("/documents/:documentId/chunks", getDocumentChunks)
 	r.GET("/documents/:documentId", getDocumentInfo)
 	r.GET("/documents/:documentId/chat", getChatHistory)
+	r.GET("/documents/:documentId/shares", listSharesHandler)
+	r.POST("/documents/:documentId/shares", shareDocumentHandler)
+	r.DELETE("/documents/:documentId/shares/:userId", unshareDocumentHandler)
+	r.POST("/documents/:documentId/retrieve", retrieveHandler)
+	r.PUT("/documents/:documentId/template", setDocumentTemplate)
+	r.POST("/documents/:documentId/summary", summaryHandler)
+	r.POST("/documents/:documentId/extract", extractHandler)
+	r.GET("/documents/:documentId/extractions", listExtractionsHandler)
+	r.GET("/extractions/:extractionId", getExtractionHandler)
+	r.POST("/extractions/:extractionId/rerun", rerunExtractionHandler)
+	r.GET("/documents/:documentId/suggestions", getSuggestionsHandler)
+	r.POST("/documents/:documentId/suggestions", regenerateSuggestionsHandler)
+	r.POST("/documents/:documentId/quiz", quizHandler)
+	r.GET("/documents/:documentId/quizzes", listQuizzesHandler)
+	r.GET("/quizzes/:quizId", getQuizHandler)
+	r.GET("/quizzes/:quizId/flashcards", flashcardsHandler)
+	r.POST("/messages/:messageId/feedback", feedbackHandler)
+	r.GET("/feedback/report", feedbackReportHandler)
+	r.POST("/collections/:collection/extract", batchExtractHandler)
+	r.GET("/batches/:batchId", getBatchHandler)
+	r.GET("/batches/:batchId/export", exportBatchHandler)
+	r.GET("/prompt-templates", listPromptTemplates)
 	r.POST("/ask", queryLLMHandler)
 	r.POST("/chat", saveChatHandler)
 	r.GET("/ws", handleWebSocket) // NEW WEBSOCKET ROUTE
@@ -1126,24 +2051,68 @@ func main() {
 	})
 
 	// Start server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-
-	log.Printf("Server starting on port %s", port)
+	log.Printf("Server starting on port %s", cfg.Port)
 	log.Printf("Available routes:")
 	log.Printf("  GET  /health")
 	log.Printf("  POST /upload")
 	log.Printf("  GET  /users/:userId/documents")
+	log.Printf("  GET  /search")
 	log.Printf("  GET  /documents/:documentId/chunks")
 	log.Printf("  GET  /documents/:documentId/info")
 	log.Printf("  GET  /documents/:documentId/chat")
+	log.Printf("  GET  /documents/:documentId/shares")
+	log.Printf("  POST /documents/:documentId/shares")
+	log.Printf("  DELETE /documents/:documentId/shares/:userId")
+	log.Printf("  POST /documents/:documentId/retrieve")
+	log.Printf("  PUT  /documents/:documentId/template")
+	log.Printf("  POST /documents/:documentId/summary")
+	log.Printf("  POST /documents/:documentId/extract")
+	log.Printf("  GET  /documents/:documentId/extractions")
+	log.Printf("  GET  /extractions/:extractionId")
+	log.Printf("  POST /extractions/:extractionId/rerun")
+	log.Printf("  GET  /documents/:documentId/suggestions")
+	log.Printf("  POST /documents/:documentId/suggestions")
+	log.Printf("  POST /documents/:documentId/quiz")
+	log.Printf("  GET  /documents/:documentId/quizzes")
+	log.Printf("  GET  /quizzes/:quizId")
+	log.Printf("  GET  /quizzes/:quizId/flashcards")
+	log.Printf("  POST /messages/:messageId/feedback")
+	log.Printf("  GET  /feedback/report")
+	log.Printf("  POST /collections/:collection/extract")
+	log.Printf("  GET  /batches/:batchId")
+	log.Printf("  GET  /batches/:batchId/export")
+	log.Printf("  GET  /prompt-templates")
 	log.Printf("  POST /ask")
 	log.Printf("  POST /chat")
 	log.Printf("  GET  /ws (WebSocket)")
 
-	if err := r.Run(":" + port); err != nil {
+	srv := &http.Server{
+		Addr:    ":" + cfg.Port,
+		Handler: r,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
 		log.Fatal("Failed to start server:", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	log.Printf("Shutting down, waiting up to %s for in-flight work", cfg.ShutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if shutdown(shutdownCtx, srv) {
+		log.Println("Shutdown complete")
+	} else {
+		log.Println("Shutdown deadline reached, cancelling remaining work")
 	}
 }
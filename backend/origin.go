@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Origins allowed when allowed_origins is not set, besides the frontend URL
+var defaultAllowedOrigins = []string{"http://localhost:3000", "http://localhost:3001", "http://localhost:8080"}
+
+// OriginPolicy decides which browser origins may call the API and open
+// WebSockets. It is shared by CORS and the WebSocket upgrader.
+type OriginPolicy struct {
+	exact    map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// Build an origin policy from exact origins ("https://docsy-xi.vercel.app")
+// and wildcard patterns ("https://docsy-*.vercel.app"). A * matches one or
+// more characters within a single host label, so it can't be used to match
+// a different domain.
+func newOriginPolicy(origins []string) *OriginPolicy {
+	policy := &OriginPolicy{exact: make(map[string]bool)}
+	for _, origin := range origins {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		if !strings.Contains(origin, "*") {
+			policy.exact[strings.ToLower(origin)] = true
+			continue
+		}
+		pattern := strings.ReplaceAll(regexp.QuoteMeta(strings.ToLower(origin)), `\*`, `[a-z0-9-]+`)
+		policy.patterns = append(policy.patterns, regexp.MustCompile("^"+pattern+"$"))
+	}
+	return policy
+}
+
+// Load the origin policy from the configured allowed origins, falling back
+// to the frontend URL and the local development origins
+func loadOriginPolicy() *OriginPolicy {
+	if len(cfg.AllowedOrigins) > 0 {
+		return newOriginPolicy(cfg.AllowedOrigins)
+	}
+	return newOriginPolicy(append([]string{cfg.FrontendURL}, defaultAllowedOrigins...))
+}
+
+// Whether an origin is allowed
+func (p *OriginPolicy) Allows(origin string) bool {
+	origin = strings.ToLower(origin)
+	if p.exact[origin] {
+		return true
+	}
+	for _, pattern := range p.patterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS origin check, logging rejected origins
+func (p *OriginPolicy) AllowCORS(origin string) bool {
+	if p.Allows(origin) {
+		return true
+	}
+	log.Printf("Rejected CORS request from origin %q", origin)
+	return false
+}
+
+// WebSocket origin check, logging rejected origins. Requests without an
+// Origin header don't come from a browser and are allowed.
+func (p *OriginPolicy) AllowWebSocket(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.Allows(origin) {
+		return true
+	}
+	log.Printf("Rejected WebSocket connection from origin %q", origin)
+	return false
+}
+
+// Origin policy in effect, set in main
+var originPolicy = newOriginPolicy(defaultAllowedOrigins)
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Identifies this backend instance in presence updates
+var instanceID = uuid.New().String()
+
+// How long another instance's room members count without a refresh. Every
+// instance republishes its rooms' members on the hub's prune tick, so the
+// members of an instance that died without saying so drop out after this.
+const presenceTTL = 3 * time.Minute
+
+// PresenceUpdate carries one instance's members of a document's room. It
+// replaces the instance's previous update for the room.
+type PresenceUpdate struct {
+	Instance string   `json:"instance"`
+	Version  int64    `json:"version"`
+	Users    []string `json:"users"`
+	// Asks the other instances to publish their members of the room, sent
+	// when the room opens on this instance
+	Request bool `json:"request,omitempty"`
+}
+
+// Room members on another instance, as last published by it
+type remotePresence struct {
+	version int64
+	users   []string
+	updated time.Time
+}
+
+// Users connected to a document on this instance, sorted. Must only be
+// called from run.
+func (h *Hub) localUsers(documentID string) []string {
+	seen := make(map[string]bool)
+	users := []string{}
+	for client := range h.rooms[documentID] {
+		if !seen[client.userID] {
+			seen[client.userID] = true
+			users = append(users, client.userID)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Tell a room's members who is viewing the document on any instance. Must
+// only be called from run.
+func (h *Hub) announcePresence(documentID string) {
+	seen := make(map[string]bool)
+	users := []string{}
+	add := func(userID string) {
+		if !seen[userID] {
+			seen[userID] = true
+			users = append(users, userID)
+		}
+	}
+	for _, userID := range h.localUsers(documentID) {
+		add(userID)
+	}
+	for _, remote := range h.remote[documentID] {
+		for _, userID := range remote.users {
+			add(userID)
+		}
+	}
+	sort.Strings(users)
+
+	for client := range h.rooms[documentID] {
+		h.send(client, WSResponse{
+			Type:      wsPresence,
+			ID:        uuid.New().String(),
+			Timestamp: time.Now().Format(time.RFC3339),
+			Users:     users,
+		})
+	}
+}
+
+// Publish this instance's members of a room to the other instances. The
+// publish runs on its own goroutine, as the backplane may block or hand the
+// event straight back to run. Must only be called from run.
+func (h *Hub) publishPresence(documentID string, request bool) {
+	if h.backplane == nil {
+		return
+	}
+	h.presenceVersion++
+	event := DocumentEvent{
+		DocumentID: documentID,
+		Presence: &PresenceUpdate{
+			Instance: instanceID,
+			Version:  h.presenceVersion,
+			Users:    h.localUsers(documentID),
+			Request:  request,
+		},
+	}
+	go h.publish(event)
+}
+
+// Record another instance's members of a room, re-announcing presence to
+// the room if it has members here. This instance's own updates are ignored;
+// its rooms are read directly. Must only be called from run.
+func (h *Hub) receivePresence(documentID string, update PresenceUpdate) {
+	if update.Instance == instanceID {
+		return
+	}
+	if update.Request && len(h.rooms[documentID]) > 0 {
+		h.membershipChanged(documentID, false)
+	}
+
+	instances := h.remote[documentID]
+	if instances == nil {
+		instances = make(map[string]*remotePresence)
+		h.remote[documentID] = instances
+	}
+	// Updates can arrive out of order; keep the newest
+	if previous := instances[update.Instance]; previous != nil && previous.version >= update.Version {
+		return
+	}
+	instances[update.Instance] = &remotePresence{version: update.Version, users: update.Users, updated: time.Now()}
+
+	if h.rooms[documentID] != nil {
+		h.changed[documentID] = true
+	}
+}
+
+// Drop other instances' members that haven't been refreshed within
+// presenceTTL, and republish this instance's members of every room. Must
+// only be called from run.
+func (h *Hub) refreshPresence() {
+	for documentID, instances := range h.remote {
+		for instance, remote := range instances {
+			if time.Since(remote.updated) > presenceTTL {
+				delete(instances, instance)
+				if h.rooms[documentID] != nil {
+					h.changed[documentID] = true
+				}
+			}
+		}
+		if len(instances) == 0 {
+			delete(h.remote, documentID)
+		}
+	}
+
+	for documentID := range h.rooms {
+		h.membershipChanged(documentID, false)
+	}
+}
+
+// Note that this instance's members of a room should be published, asking
+// the other instances for theirs if request is set. Must only be called
+// from run.
+func (h *Hub) membershipChanged(documentID string, request bool) {
+	h.membership[documentID] = h.membership[documentID] || request
+}
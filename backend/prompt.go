@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Label put before each chunk in an answer prompt. Answer templates ask the
+// model to cite pages in the same form.
+const pageLabelFormat = "[page %d]"
+
+// A line holding only a page label
+var pageLabelPattern = regexp.MustCompile(`^\[page (\d+)\]$`)
+
+// Page citations in an answer: [page 3], [pages 3, 4] or [pages 3 and 4]
+var citationPattern = regexp.MustCompile(`(?i)\[pages?\s+(\d+(?:\s*(?:,|and)\s*\d+)*)\]`)
+
+// Status of a retrieved chunk in the assembled prompt
+const (
+	chunkIncluded  = "included"
+	chunkTruncated = "truncated"
+	chunkDropped   = "dropped"
+)
+
+// ContextChunk records what happened to a retrieved chunk when the prompt was built
+type ContextChunk struct {
+	ID         string  `json:"id"`
+	ChunkIndex int     `json:"chunk_index"`
+	PageNumber int     `json:"page_number,omitempty"`
+	Score      float64 `json:"score"`
+	Status     string  `json:"status"`
+	Tokens     int     `json:"tokens"` // Estimated
+}
+
+// PromptRequest is everything that goes into an answer prompt
+type PromptRequest struct {
+	Template string
+	Question string
+	History  []ChatMessage
+	Settings map[string]string
+	Chunks   []RetrievedChunk
+}
+
+// AnswerPrompt is an assembled prompt and the chunks that went into it
+type AnswerPrompt struct {
+	Template      string         `json:"template"`
+	Text          string         `json:"prompt"`
+	PromptTokens  int            `json:"prompt_tokens"`  // Counted with the configured tokenizer
+	ContextTokens int            `json:"context_tokens"` // Estimated
+	HistoryTokens int            `json:"history_tokens"` // Estimated
+	BudgetTokens  int            `json:"budget_tokens"`
+	Chunks        []ContextChunk `json:"chunks"`
+}
+
+// Fill a context budget with ranked chunks, each labelled with its page.
+// Chunks are taken in rank order until the budget runs out; the chunk that
+// crosses the limit is cut at a word boundary if enough room is left, and
+// the rest are dropped.
+func packChunks(t Tokenizer, chunks []RetrievedChunk, budget int) (string, []ContextChunk) {
+	var contentBuilder strings.Builder
+	report := make([]ContextChunk, 0, len(chunks))
+	remaining := budget
+
+	for _, chunk := range chunks {
+		entry := ContextChunk{
+			ID:         chunk.ID,
+			ChunkIndex: chunk.ChunkIndex,
+			PageNumber: chunk.PageNumber,
+			Score:      chunk.Score,
+			Status:     chunkIncluded,
+		}
+
+		label := ""
+		if chunk.PageNumber > 0 {
+			label = fmt.Sprintf(pageLabelFormat, chunk.PageNumber) + "\n"
+		}
+		labelTokens := t.CountTokens(label)
+
+		text := chunk.Content
+		tokens := t.CountTokens(text)
+		switch {
+		case labelTokens+tokens <= remaining:
+		case remaining-labelTokens >= minTruncatedChunkTokens:
+			text = truncateToTokens(t, text, remaining-labelTokens)
+			tokens = t.CountTokens(text)
+			entry.Status = chunkTruncated
+		default:
+			text = ""
+			tokens = 0
+			entry.Status = chunkDropped
+		}
+
+		if text != "" {
+			contentBuilder.WriteString(label + text + "\n\n")
+			tokens += labelTokens
+		}
+		remaining -= tokens
+		entry.Tokens = tokens
+		report = append(report, entry)
+	}
+
+	return contentBuilder.String(), report
+}
+
+// Sorted distinct pages cited in an answer
+func citedPages(answer string) []int {
+	seen := make(map[int]bool)
+	pages := []int{}
+	for _, match := range citationPattern.FindAllStringSubmatch(answer, -1) {
+		for _, field := range strings.FieldsFunc(match[1], func(r rune) bool { return r < '0' || r > '9' }) {
+			page, err := strconv.Atoi(field)
+			if err == nil && page > 0 && !seen[page] {
+				seen[page] = true
+				pages = append(pages, page)
+			}
+		}
+	}
+	sort.Ints(pages)
+	return pages
+}
+
+// The page of a page label line
+func parsePageLabel(line string) (int, bool) {
+	match := pageLabelPattern.FindStringSubmatch(line)
+	if match == nil {
+		return 0, false
+	}
+	page, err := strconv.Atoi(match[1])
+	return page, err == nil
+}
+
+// Remove page citations from an answer
+func stripCitations(answer string) string {
+	return strings.TrimSpace(citationPattern.ReplaceAllString(answer, ""))
+}
+
+// Keep the most recent messages that fit in the history budget
+func fitHistory(t Tokenizer, history []ChatMessage, budget int) string {
+	start := len(history)
+	for start > 0 && t.CountTokens(formatHistory(history[start-1:])) <= budget {
+		start--
+	}
+	return formatHistory(history[start:])
+}
+
+// Build the answer prompt from ranked chunks within the model's token budget.
+// Chunks are packed using the estimator; the finished prompt is then counted
+// once with the configured tokenizer, and if that count is above the estimate
+// the context is packed again with the difference taken off its budget.
+func buildAnswerPrompt(req PromptRequest) (AnswerPrompt, error) {
+	budget := budgetForModel(provider.Model())
+	result := AnswerPrompt{Template: req.Template}
+
+	data := PromptData{
+		History:  fitHistory(estimator, req.History, budget.HistoryTokens),
+		Question: req.Question,
+		Settings: req.Settings,
+	}
+
+	empty, err := renderPromptTemplate(req.Template, data)
+	if err != nil {
+		return result, err
+	}
+
+	result.BudgetTokens = budget.contextTokens(estimator.CountTokens(empty))
+	data.Context, result.Chunks = packChunks(estimator, req.Chunks, result.BudgetTokens)
+
+	if result.Text, err = renderPromptTemplate(req.Template, data); err != nil {
+		return result, err
+	}
+
+	result.PromptTokens = tokenizer.CountTokens(result.Text)
+	if over := result.PromptTokens - estimator.CountTokens(result.Text); over > 0 && data.Context != "" {
+		result.BudgetTokens = max(result.BudgetTokens-over, 0)
+		data.Context, result.Chunks = packChunks(estimator, req.Chunks, result.BudgetTokens)
+		if result.Text, err = renderPromptTemplate(req.Template, data); err != nil {
+			return result, err
+		}
+		result.PromptTokens = tokenizer.CountTokens(result.Text)
+	}
+
+	result.ContextTokens = estimator.CountTokens(data.Context)
+	result.HistoryTokens = estimator.CountTokens(data.History)
+
+	return result, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCitedPages(t *testing.T) {
+	tests := []struct {
+		answer string
+		want   []int
+	}{
+		{"The lease ends on 31 March 2026 [page 4].", []int{4}},
+		{"Rent is due monthly [Page 2] and the deposit is returned [pages 5, 3].", []int{2, 3, 5}},
+		{"See [pages 2 and 7] and again [page 2].", []int{2, 7}},
+		{"No citation here, only [3] and page 4.", []int{}},
+	}
+
+	for _, tt := range tests {
+		if got := citedPages(tt.answer); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("citedPages(%q) = %v, want %v", tt.answer, got, tt.want)
+		}
+	}
+
+	if got := stripCitations("Monthly [page 2]"); got != "Monthly" {
+		t.Errorf("stripCitations() = %q, want %q", got, "Monthly")
+	}
+}
+
+func TestPackChunksLabelsPages(t *testing.T) {
+	chunks := []RetrievedChunk{
+		{ID: "a", PageNumber: 3, Content: "First chunk."},
+		{ID: "b", Content: "Chunk with no known page."},
+	}
+
+	content, report := packChunks(estimator, chunks, 1000)
+	want := "[page 3]\nFirst chunk.\n\nChunk with no known page.\n\n"
+	if content != want {
+		t.Errorf("packChunks() content = %q, want %q", content, want)
+	}
+	if report[0].Tokens != estimator.CountTokens("[page 3]\n")+estimator.CountTokens("First chunk.") {
+		t.Errorf("packChunks() counted %d tokens for the labelled chunk, want the label included", report[0].Tokens)
+	}
+}
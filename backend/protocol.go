@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket protocol version, negotiated with the Sec-WebSocket-Protocol
+// header. See docs/websocket-protocol.md.
+const wsProtocolV1 = "docsy.v1"
+
+// Protocol versions the server speaks, newest first
+var wsProtocols = []string{wsProtocolV1}
+
+// Client message types
+const (
+	wsQuery    = "query"
+	wsCancel   = "cancel"
+	wsFeedback = "feedback"
+	wsTyping   = "typing"
+)
+
+// Server frame types
+const (
+	wsReady       = "ready"
+	wsAck         = "ack"
+	wsChunk       = "chunk"
+	wsResponse    = "response"
+	wsCancelled   = "cancelled"
+	wsError       = "error"
+	wsSuggestions = "suggestions"
+	wsFeedbackAck = "feedback"
+	wsMessage     = "message"
+	wsPresence    = "presence"
+)
+
+// Error codes carried by error frames
+const (
+	wsErrBadMessage     = "bad_message"
+	wsErrUnknownType    = "unknown_type"
+	wsErrInvalidRequest = "invalid_request"
+	wsErrUnknownRequest = "unknown_request"
+	wsErrNotFound       = "not_found"
+	wsErrNoContent      = "no_content"
+	wsErrRetrieval      = "retrieval_failed"
+	wsErrProvider       = "provider_error"
+	wsErrInternal       = "internal_error"
+	wsErrUnavailable    = "unavailable"
+)
+
+// Pick the protocol version for a connection. Clients that offer no
+// subprotocol get v1; clients that offer only versions the server doesn't
+// speak are refused.
+func negotiateProtocol(r *http.Request) (string, error) {
+	offered := websocket.Subprotocols(r)
+	if len(offered) == 0 {
+		return wsProtocolV1, nil
+	}
+
+	for _, supported := range wsProtocols {
+		for _, protocol := range offered {
+			if protocol == supported {
+				return supported, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unsupported protocol %s; supported: %s", strings.Join(offered, ", "), strings.Join(wsProtocols, ", "))
+}
+
+// Check a client message before it is handled, returning an error code and
+// message for the error frame
+func validateWSMessage(msg WSMessage) (string, error) {
+	switch msg.Type {
+	case wsQuery:
+		if strings.TrimSpace(msg.Content) == "" {
+			return wsErrInvalidRequest, fmt.Errorf("query content is required")
+		}
+	case wsCancel:
+		if msg.RequestID == "" {
+			return wsErrInvalidRequest, fmt.Errorf("requestId is required")
+		}
+	case wsFeedback:
+		if msg.MessageID == "" || msg.Rating == "" {
+			return wsErrInvalidRequest, fmt.Errorf("messageId and rating are required")
+		}
+	case wsTyping:
+		if msg.Content != "start" && msg.Content != "stop" {
+			return wsErrInvalidRequest, fmt.Errorf(`typing content must be "start" or "stop"`)
+		}
+	case "":
+		return wsErrBadMessage, fmt.Errorf("message type is required")
+	default:
+		return wsErrUnknownType, fmt.Errorf("unknown message type %q", msg.Type)
+	}
+	return "", nil
+}
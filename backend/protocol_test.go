@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestValidateWSMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  WSMessage
+		code string
+	}{
+		{"query", WSMessage{Type: wsQuery, Content: "When does the lease end?"}, ""},
+		{"blank query", WSMessage{Type: wsQuery, Content: "  "}, wsErrInvalidRequest},
+		{"cancel", WSMessage{Type: wsCancel, RequestID: "r1"}, ""},
+		{"cancel without requestId", WSMessage{Type: wsCancel}, wsErrInvalidRequest},
+		{"feedback", WSMessage{Type: wsFeedback, MessageID: "m1", Rating: "up"}, ""},
+		{"feedback without rating", WSMessage{Type: wsFeedback, MessageID: "m1"}, wsErrInvalidRequest},
+		{"typing start", WSMessage{Type: wsTyping, Content: "start"}, ""},
+		{"typing stop", WSMessage{Type: wsTyping, Content: "stop"}, ""},
+		{"typing other", WSMessage{Type: wsTyping, Content: "pause"}, wsErrInvalidRequest},
+		{"missing type", WSMessage{Content: "hello"}, wsErrBadMessage},
+		{"unknown type", WSMessage{Type: "dance"}, wsErrUnknownType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := validateWSMessage(tt.msg)
+			if code != tt.code {
+				t.Errorf("validateWSMessage() code = %q, want %q", code, tt.code)
+			}
+			if (err != nil) != (tt.code != "") {
+				t.Errorf("validateWSMessage() error = %v, want error %v", err, tt.code != "")
+			}
+		})
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	server, _ := startTestServer(t)
+
+	tests := []struct {
+		name      string
+		protocols []string
+		echoed    string
+	}{
+		{"no subprotocol", nil, ""},
+		{"v1", []string{wsProtocolV1}, wsProtocolV1},
+		{"unknown and v1", []string{"docsy.v9", wsProtocolV1}, wsProtocolV1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, resp, err := dialTestServer(server, "handshake-user", tt.protocols...)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+
+			if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != tt.echoed {
+				t.Errorf("Sec-WebSocket-Protocol = %q, want %q", got, tt.echoed)
+			}
+
+			frame, err := readFrame(conn, 5*time.Second)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if frame.Type != wsReady || frame.Content != wsProtocolV1 {
+				t.Errorf("first frame = %+v, want ready with version %s", frame, wsProtocolV1)
+			}
+		})
+	}
+}
+
+func TestWebSocketRefusesUnknownProtocol(t *testing.T) {
+	server, _ := startTestServer(t)
+
+	conn, resp, err := dialTestServer(server, "handshake-user", "docsy.v9")
+	if err == nil {
+		conn.Close()
+		t.Fatal("dial succeeded, want the handshake refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("response = %v, want status 400", resp)
+	}
+}
+
+func TestWebSocketMessageErrors(t *testing.T) {
+	server, _ := startTestServer(t)
+
+	conn, _, err := dialTestServer(server, "protocol-user", wsProtocolV1)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if frame, err := readFrame(conn, 5*time.Second); err != nil || frame.Type != wsReady {
+		t.Fatalf("first frame = %+v, %v; want ready", frame, err)
+	}
+
+	tests := []struct {
+		name string
+		raw  string
+		code string
+	}{
+		{"invalid JSON", `{"type": "query"`, wsErrBadMessage},
+		{"unknown type", `{"type": "dance", "id": "m1"}`, wsErrUnknownType},
+		{"cancel without requestId", `{"type": "cancel", "id": "m2"}`, wsErrInvalidRequest},
+		{"missing type", `{"content": "hello", "id": "m3"}`, wsErrBadMessage},
+		{"valid typing", `{"type": "typing", "content": "start", "id": "m4"}`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(tt.raw)); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			// Frames are sent in order, so once the ack of the sentinel
+			// arrives every frame for the message under test has too
+			if err := conn.WriteJSON(WSMessage{Type: wsTyping, Content: "stop", ID: "sentinel"}); err != nil {
+				t.Fatalf("write sentinel: %v", err)
+			}
+
+			var errorFrames []WSResponse
+			var acks []string
+			for {
+				frame, err := readFrame(conn, 5*time.Second)
+				if err != nil {
+					t.Fatalf("read: %v", err)
+				}
+				if frame.Type == wsAck && frame.ID == "sentinel" {
+					break
+				}
+				switch frame.Type {
+				case wsError:
+					errorFrames = append(errorFrames, frame)
+				case wsAck:
+					acks = append(acks, frame.ID)
+				}
+			}
+
+			if tt.code == "" {
+				if len(errorFrames) > 0 {
+					t.Errorf("got error frames %+v, want none", errorFrames)
+				}
+				if len(acks) != 1 || acks[0] != "m4" {
+					t.Errorf("acks = %v, want one ack echoing m4", acks)
+				}
+				return
+			}
+
+			if len(errorFrames) != 1 || errorFrames[0].Code != tt.code {
+				t.Errorf("error frames = %+v, want one with code %s", errorFrames, tt.code)
+			}
+			if len(acks) > 0 {
+				t.Errorf("acks = %v, want a message failing validation not to be acked", acks)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// LLMProvider is the model backend behind answers, internal JSON pipeline
+// steps and embeddings
+type LLMProvider interface {
+	// Model name, used to pick the token budget and recorded with answers
+	Model() string
+	// Cancelling ctx aborts any call and returns ctx's error
+	Generate(ctx context.Context, prompt string) (string, error)
+	// Stream an answer, calling onChunk with each piece of text. Cancelling
+	// ctx returns the text so far with ctx's error.
+	Stream(ctx context.Context, prompt string, onChunk func(string)) (string, error)
+	GenerateJSON(ctx context.Context, prompt string) (string, error)
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// Global provider, selected with LLM_PROVIDER
+var provider LLMProvider = GeminiProvider{}
+
+// Create a provider by name: "gemini" (default) or "fake"
+func newProvider(name string) (LLMProvider, error) {
+	switch strings.ToLower(name) {
+	case "", "gemini":
+		return GeminiProvider{}, nil
+	case "fake":
+		return FakeProvider{}, nil
+	default:
+		return nil, fmt.Errorf("unknown LLM provider %q", name)
+	}
+}
+
+// GeminiProvider calls the Gemini REST API
+type GeminiProvider struct{}
+
+func (GeminiProvider) Model() string {
+	return cfg.LLMModel
+}
+
+func (GeminiProvider) Generate(ctx context.Context, prompt string) (string, error) {
+	return callGeminiAPI(ctx, prompt)
+}
+
+func (GeminiProvider) Stream(ctx context.Context, prompt string, onChunk func(string)) (string, error) {
+	return callGeminiStream(ctx, prompt, onChunk)
+}
+
+func (GeminiProvider) GenerateJSON(ctx context.Context, prompt string) (string, error) {
+	return callGeminiJSON(ctx, prompt)
+}
+
+func (GeminiProvider) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	return callGeminiEmbedAPI(ctx, texts)
+}
+
+// FakeProvider is a deterministic offline provider for evaluation and local
+// development. Embeddings are hashed bags of words, answers are the sentence
+// of the prompt that shares the most words with the question, and the query
+// rewriting, expansion and reranking steps get well-formed JSON answers built
+// from word overlap, so those stages run rather than fall back.
+type FakeProvider struct{}
+
+func (FakeProvider) Model() string {
+	return "fake"
+}
+
+// Answer with the prompt sentence closest to the question, citing the page
+// label it follows. The question is taken to be the last sentence ending in
+// a question mark.
+func (FakeProvider) Generate(ctx context.Context, prompt string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	sentences := splitSentences(prompt)
+
+	question := -1
+	for i := len(sentences) - 1; i >= 0; i-- {
+		if strings.HasSuffix(sentences[i], "?") {
+			question = i
+			break
+		}
+	}
+	if question < 0 {
+		if len(sentences) == 0 {
+			return "", nil
+		}
+		return sentences[0], nil
+	}
+
+	terms := make(map[string]bool)
+	for _, term := range tokenize(sentences[question]) {
+		terms[term] = true
+	}
+
+	best, bestScore, bestPage, page := "", 0, 0, 0
+	for i, sentence := range sentences {
+		if i == question {
+			continue
+		}
+		if labelled, ok := parsePageLabel(sentence); ok {
+			page = labelled
+			continue
+		}
+		score := 0
+		for _, term := range tokenize(sentence) {
+			if terms[term] {
+				score++
+			}
+		}
+		if score > bestScore {
+			best, bestScore, bestPage = sentence, score, page
+		}
+	}
+	if best != "" && bestPage > 0 {
+		best += " " + fmt.Sprintf(pageLabelFormat, bestPage)
+	}
+	return best, nil
+}
+
+// Stream the fake answer word by word
+func (p FakeProvider) Stream(ctx context.Context, prompt string, onChunk func(string)) (string, error) {
+	answer, err := p.Generate(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+
+	var streamed strings.Builder
+	for i, word := range strings.Fields(answer) {
+		if ctx.Err() != nil {
+			return streamed.String(), ctx.Err()
+		}
+		if i > 0 {
+			word = " " + word
+		}
+		streamed.WriteString(word)
+		if onChunk != nil {
+			onChunk(word)
+		}
+	}
+	return streamed.String(), nil
+}
+
+// Answer the pipeline's JSON prompts, recognised by their output format:
+// rewriting returns the question unchanged, expansion returns keyword
+// variants of the question and reranking grades passages by the share of
+// question words they contain. Other prompts get an empty object.
+func (FakeProvider) GenerateJSON(ctx context.Context, prompt string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	var output interface{} = map[string]interface{}{}
+	switch {
+	case strings.Contains(prompt, rewriteOutputFormat):
+		output = map[string]string{"question": promptLine(prompt, rewriteQuestionLabel)}
+	case strings.Contains(prompt, rerankOutputFormat):
+		output = fakeGrades(promptLine(prompt, stageQuestionLabel), prompt)
+	default:
+		var n int
+		if _, err := fmt.Sscanf(prompt, expandInstruction, &n); err == nil {
+			output = fakeParaphrases(promptLine(prompt, stageQuestionLabel), n)
+		}
+	}
+
+	response, err := json.Marshal(output)
+	if err != nil {
+		return "", err
+	}
+	return string(response), nil
+}
+
+// Rest of the first prompt line starting with prefix
+func promptLine(prompt, prefix string) string {
+	for _, line := range strings.Split(prompt, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimSpace(strings.TrimPrefix(line, prefix))
+		}
+	}
+	return ""
+}
+
+// Keyword variants of a question: its words, its longer words, and its
+// words in reverse order
+func fakeParaphrases(question string, n int) []string {
+	terms := tokenize(question)
+	var long []string
+	for _, term := range terms {
+		if len(term) > 3 {
+			long = append(long, term)
+		}
+	}
+	reversed := make([]string, len(terms))
+	for i, term := range terms {
+		reversed[len(terms)-1-i] = term
+	}
+
+	paraphrases := []string{strings.Join(terms, " "), strings.Join(long, " "), strings.Join(reversed, " ")}
+	if n >= 0 && len(paraphrases) > n {
+		paraphrases = paraphrases[:n]
+	}
+	return paraphrases
+}
+
+// Grade each passage of a rerank prompt 0 to 10 by the share of question
+// words it contains
+func fakeGrades(question, prompt string) []map[string]float64 {
+	terms := make(map[string]bool)
+	for _, term := range tokenize(question) {
+		terms[term] = true
+	}
+
+	// The passages end at the line describing the output format
+	if end := strings.LastIndex(prompt, rerankOutputFormat); end >= 0 {
+		prompt = prompt[:strings.LastIndex(prompt[:end], "\n")+1]
+	}
+
+	grades := []map[string]float64{}
+	markers := rerankPassagePattern.FindAllStringSubmatchIndex(prompt, -1)
+	for i, marker := range markers {
+		end := len(prompt)
+		if i+1 < len(markers) {
+			end = markers[i+1][0]
+		}
+		index, _ := strconv.Atoi(prompt[marker[2]:marker[3]])
+
+		found := make(map[string]bool)
+		for _, term := range tokenize(prompt[marker[1]:end]) {
+			if terms[term] {
+				found[term] = true
+			}
+		}
+		score := 0.0
+		if len(terms) > 0 {
+			score = math.Round(100*float64(len(found))/float64(len(terms))) / 10
+		}
+		grades = append(grades, map[string]float64{"index": float64(index), "score": score})
+	}
+	return grades
+}
+
+// Hash each word into one of the embedding dimensions and normalise
+func (FakeProvider) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	embeddings := make([][]float32, len(texts))
+	for i, text := range texts {
+		vector := make([]float32, embeddingDimensions)
+		for _, term := range tokenize(text) {
+			h := fnv.New32a()
+			h.Write([]byte(term))
+			vector[h.Sum32()%embeddingDimensions]++
+		}
+
+		var norm float64
+		for _, v := range vector {
+			norm += float64(v) * float64(v)
+		}
+		if norm > 0 {
+			scale := float32(1 / math.Sqrt(norm))
+			for j := range vector {
+				vector[j] *= scale
+			}
+		}
+		embeddings[i] = vector
+	}
+	return embeddings, nil
+}
+
+// Split text into trimmed sentences and lines
+func splitSentences(text string) []string {
+	var sentences []string
+	start := 0
+	for i, r := range text {
+		if r == '.' || r == '?' || r == '!' || r == '\n' {
+			if s := strings.TrimSpace(text[start : i+1]); len(s) > 1 {
+				sentences = append(sentences, s)
+			}
+			start = i + 1
+		}
+	}
+	if s := strings.TrimSpace(text[start:]); s != "" {
+		sentences = append(sentences, s)
+	}
+	return sentences
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// The fake provider's JSON answers must parse in the pipeline stages that
+// use them, so eval runs with the fake provider exercise those stages
+func TestFakeProviderJSONStages(t *testing.T) {
+	previous := provider
+	provider = FakeProvider{}
+	defer func() { provider = previous }()
+
+	history := []ChatMessage{
+		{MessageType: "user", MessageContent: "Who is the landlord?"},
+		{MessageType: "bot", MessageContent: "Acme Ltd."},
+	}
+	rewritten, err := rewriteQuery(context.Background(), "When does their lease end?", history)
+	if err != nil || rewritten != "When does their lease end?" {
+		t.Errorf("rewriteQuery() = %q, %v; want the question unchanged", rewritten, err)
+	}
+
+	paraphrases, err := expandQuery(context.Background(), "When does the lease end?", expansionParaphrases)
+	if err != nil {
+		t.Fatalf("expandQuery() error: %v", err)
+	}
+	if len(paraphrases) == 0 || len(paraphrases) > expansionParaphrases {
+		t.Errorf("expandQuery() returned %d paraphrases, want 1 to %d", len(paraphrases), expansionParaphrases)
+	}
+
+	chunks := []RetrievedChunk{
+		{ID: "a", Content: "The rent is paid monthly."},
+		{ID: "b", Content: "The lease will end on 31 March 2026."},
+	}
+	reranked, err := LLMReranker{}.Rerank(context.Background(), "When does the lease end?", chunks)
+	if err != nil {
+		t.Fatalf("Rerank() error: %v", err)
+	}
+	if reranked[0].ID != "b" || reranked[0].RerankScore <= reranked[1].RerankScore {
+		t.Errorf("Rerank() = %+v, want the lease passage first", reranked)
+	}
+}
+
+// The fake answer cites the page of the passage it was taken from, so eval
+// runs with the fake provider score citations
+func TestFakeProviderCitesPages(t *testing.T) {
+	chunks := []RetrievedChunk{
+		{ID: "a", PageNumber: 1, Content: "The rent is paid monthly."},
+		{ID: "b", PageNumber: 4, Content: "The lease will end on 31 March 2026."},
+	}
+	content, _ := packChunks(estimator, chunks, 1000)
+
+	answer, err := FakeProvider{}.Generate(context.Background(), content+"\nUser Question: When does the lease end?")
+	if err != nil {
+		t.Fatalf("Generate() error: %v", err)
+	}
+	if pages := citedPages(answer); len(pages) != 1 || pages[0] != 4 {
+		t.Errorf("Generate() = %q, want an answer citing page 4", answer)
+	}
+}
+
+// Cancelling the query's context stops the pipeline stages' model calls
+func TestQueryStagesStopWhenCancelled(t *testing.T) {
+	previous := provider
+	provider = FakeProvider{}
+	defer func() { provider = previous }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	history := []ChatMessage{{MessageType: "user", MessageContent: "Who is the tenant?"}}
+	if _, err := rewriteQuery(ctx, "When does their lease end?", history); err != context.Canceled {
+		t.Errorf("rewriteQuery() error = %v, want %v", err, context.Canceled)
+	}
+	if _, err := expandQuery(ctx, "When does the lease end?", expansionParaphrases); err != context.Canceled {
+		t.Errorf("expandQuery() error = %v, want %v", err, context.Canceled)
+	}
+	chunks := []RetrievedChunk{{ID: "a", Content: "The lease will end on 31 March 2026."}}
+	if _, err := (LLMReranker{}).Rerank(ctx, "When does the lease end?", chunks); err != context.Canceled {
+		t.Errorf("Rerank() error = %v, want %v", err, context.Canceled)
+	}
+}
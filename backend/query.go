@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Number of previous chat messages loaded as conversation history
+const historyMessages = 10
+
+// Number of paraphrases generated for multi-query expansion
+const expansionParaphrases = 3
+
+// QueryOptions toggles the query pipeline stages that run before retrieval
+type QueryOptions struct {
+	// Rewrite the question into a standalone question using chat history
+	Rewrite bool
+	// Retrieve with several paraphrases and merge the results
+	Expand bool
+}
+
+// Resolve per-request toggles, falling back to the deployment defaults
+func resolveQueryOptions(rewrite, expand *bool) QueryOptions {
+	opts := QueryOptions{
+		Rewrite: cfg.QueryRewrite,
+		Expand:  cfg.QueryExpansion,
+	}
+	if rewrite != nil {
+		opts.Rewrite = *rewrite
+	}
+	if expand != nil {
+		opts.Expand = *expand
+	}
+	return opts
+}
+
+// RetrievalResult is the output of the query pipeline
+type RetrievalResult struct {
+	// Question after rewriting, used for retrieval only; equal to the
+	// original when rewriting is off
+	Question string `json:"question"`
+	// All queries used for retrieval, the question first
+	Queries []string         `json:"queries"`
+	Chunks  []RetrievedChunk `json:"chunks"`
+}
+
+// Fetch the most recent chat messages of a conversation, oldest first
+func fetchRecentMessages(ctx context.Context, documentID, userID string, limit int) ([]ChatMessage, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, message_type, message_content, timestamp
+		FROM (
+			SELECT id, message_type, message_content, timestamp
+			FROM chat_messages
+			WHERE document_id = $1 AND user_id = $2
+			ORDER BY timestamp DESC
+			LIMIT $3
+		) recent
+		ORDER BY timestamp ASC`, documentID, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch chat history: %v", err)
+	}
+	defer rows.Close()
+
+	var messages []ChatMessage
+	for rows.Next() {
+		var msg ChatMessage
+		if err := rows.Scan(&msg.ID, &msg.MessageType, &msg.MessageContent, &msg.Timestamp); err != nil {
+			log.Printf("Error scanning message: %v", err)
+			continue
+		}
+		msg.DocumentID = documentID
+		msg.UserID = userID
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+// Format chat messages as a transcript for prompts
+func formatHistory(messages []ChatMessage) string {
+	var history strings.Builder
+	for _, msg := range messages {
+		role := "User"
+		if msg.MessageType == "bot" {
+			role = "Assistant"
+		}
+		fmt.Fprintf(&history, "%s: %s\n", role, msg.MessageContent)
+	}
+	return history.String()
+}
+
+// Load the conversation preceding a question. The question is saved before
+// it is answered, so a trailing copy of it is dropped.
+// Errors are logged and treated as no history.
+func loadHistory(ctx context.Context, documentID, userID, question string) []ChatMessage {
+	if userID == "" {
+		return nil
+	}
+
+	history, err := fetchRecentMessages(ctx, documentID, userID, historyMessages)
+	if err != nil {
+		log.Printf("Error fetching chat history: %v", err)
+		return nil
+	}
+
+	if n := len(history); n > 0 && history[n-1].MessageType == "user" && history[n-1].MessageContent == question {
+		history = history[:n-1]
+	}
+	return history
+}
+
+// Parts of the rewriting and expansion prompts that FakeProvider recognises
+// them by
+const (
+	rewriteQuestionLabel = "Latest question: "
+	rewriteOutputFormat  = `{"question": "<standalone question>"}`
+	expandInstruction    = "Write %d different search queries"
+	stageQuestionLabel   = "Question: "
+)
+
+// Rewrite a follow-up question into a standalone question
+func rewriteQuery(ctx context.Context, question string, history []ChatMessage) (string, error) {
+	if len(history) == 0 {
+		return question, nil
+	}
+
+	prompt := fmt.Sprintf(`Rewrite the user's latest question so it can be understood without the conversation, resolving pronouns and references to earlier messages. Keep exact identifiers, numbers and quoted terms unchanged. If the question is already standalone, return it as is.
+
+Conversation:
+%s
+`+rewriteQuestionLabel+`%s
+
+Return a JSON object of the form `+rewriteOutputFormat+`.`, formatHistory(history), question)
+
+	response, err := provider.GenerateJSON(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+
+	var rewritten struct {
+		Question string `json:"question"`
+	}
+	if err := json.Unmarshal([]byte(response), &rewritten); err != nil {
+		return "", fmt.Errorf("failed to parse rewritten question: %v", err)
+	}
+	if strings.TrimSpace(rewritten.Question) == "" {
+		return question, nil
+	}
+
+	return strings.TrimSpace(rewritten.Question), nil
+}
+
+// Generate paraphrases of a question for multi-query retrieval
+func expandQuery(ctx context.Context, question string, n int) ([]string, error) {
+	prompt := fmt.Sprintf(expandInstruction+` that would find passages in a document answering the question below. Vary the wording and use likely synonyms, but keep exact identifiers, numbers and quoted terms unchanged.
+
+`+stageQuestionLabel+`%s
+
+Return a JSON array of strings.`, n, question)
+
+	response, err := provider.GenerateJSON(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	var paraphrases []string
+	if err := json.Unmarshal([]byte(response), &paraphrases); err != nil {
+		return nil, fmt.Errorf("failed to parse paraphrases: %v", err)
+	}
+
+	var queries []string
+	seen := map[string]bool{strings.ToLower(question): true}
+	for _, p := range paraphrases {
+		p = strings.TrimSpace(p)
+		if p == "" || seen[strings.ToLower(p)] {
+			continue
+		}
+		seen[strings.ToLower(p)] = true
+		queries = append(queries, p)
+		if len(queries) == n {
+			break
+		}
+	}
+
+	return queries, nil
+}
+
+// Merge the rankings of several queries with reciprocal rank fusion, keeping
+// one entry per chunk
+func mergeRankings(rankings [][]RetrievedChunk, k float64, limit int) []RetrievedChunk {
+	merged := make(map[string]*RetrievedChunk)
+	var order []string
+
+	for _, ranking := range rankings {
+		for rank, chunk := range ranking {
+			entry, ok := merged[chunk.ID]
+			if !ok {
+				chunk := chunk
+				chunk.Score = 0
+				entry = &chunk
+				merged[chunk.ID] = entry
+				order = append(order, chunk.ID)
+			}
+			entry.Score += 1 / (k + float64(rank+1))
+		}
+	}
+
+	chunks := make([]RetrievedChunk, 0, len(order))
+	for _, id := range order {
+		chunks = append(chunks, *merged[id])
+	}
+
+	sortByScore(chunks)
+	if len(chunks) > limit {
+		chunks = chunks[:limit]
+	}
+
+	return chunks
+}
+
+// Run the query pipeline: optional rewriting, optional expansion, then
+// retrieval with all queries. The rewritten question is only used for
+// retrieval; answers are generated for the question the user asked.
+// Failures in the optional stages are logged and the pipeline continues with
+// what it has.
+func retrieveForQuery(ctx context.Context, documentID, question string, history []ChatMessage, opts QueryOptions) (*RetrievalResult, error) {
+	result := &RetrievalResult{Question: question}
+
+	if opts.Rewrite {
+		if rewritten, err := rewriteQuery(ctx, question, history); err != nil {
+			log.Printf("Error rewriting query: %v", err)
+		} else {
+			result.Question = rewritten
+		}
+	}
+
+	result.Queries = []string{result.Question}
+	if opts.Expand {
+		paraphrases, err := expandQuery(ctx, result.Question, expansionParaphrases)
+		if err != nil {
+			log.Printf("Error expanding query: %v", err)
+		} else {
+			result.Queries = append(result.Queries, paraphrases...)
+		}
+	}
+
+	chunks, err := retrieveChunks(ctx, documentID, result.Queries)
+	if err != nil {
+		return nil, err
+	}
+	result.Chunks = chunks
+
+	return result, nil
+}
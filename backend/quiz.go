@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Quiz question types
+const (
+	quizMultipleChoice = "multiple_choice"
+	quizShortAnswer    = "short_answer"
+)
+
+// Quiz size limits
+const (
+	defaultQuizCount = 10
+	maxQuizCount     = 30
+)
+
+// Extra attempts made when the model's quiz fails validation
+const quizRepairAttempts = 1
+
+// Instructions for each difficulty
+var quizDifficulties = map[string]string{
+	"easy":   "Ask about facts stated directly in the text: definitions, names, numbers and key points.",
+	"medium": "Mix recall of facts with questions that require understanding how ideas in the text relate.",
+	"hard":   "Ask questions that require combining information from different parts of the text, applying it to a scenario, or drawing conclusions it supports.",
+}
+
+// Shape the model's quiz output must take
+var quizOutputSchema = map[string]interface{}{
+	"type":     "object",
+	"required": []interface{}{"questions"},
+	"properties": map[string]interface{}{
+		"questions": map[string]interface{}{
+			"type":     "array",
+			"minItems": float64(1),
+			"items": map[string]interface{}{
+				"type":     "object",
+				"required": []interface{}{"type", "question", "answer", "chunk"},
+				"properties": map[string]interface{}{
+					"type":        map[string]interface{}{"enum": []interface{}{quizMultipleChoice, quizShortAnswer}},
+					"question":    map[string]interface{}{"type": "string", "minLength": float64(1)},
+					"options":     map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+					"answer":      map[string]interface{}{"type": "string", "minLength": float64(1)},
+					"explanation": map[string]interface{}{"type": "string"},
+					"chunk":       map[string]interface{}{"type": "integer"},
+					"quote":       map[string]interface{}{"type": "string"},
+				},
+			},
+		},
+	},
+}
+
+// QuizQuestion is one question with its answer key and source
+type QuizQuestion struct {
+	Type        string   `json:"type"`
+	Question    string   `json:"question"`
+	Options     []string `json:"options,omitempty"`
+	Answer      string   `json:"answer"`
+	Explanation string   `json:"explanation,omitempty"`
+	ChunkIndex  int      `json:"chunk_index"`
+	PageNumber  int      `json:"page_number,omitempty"`
+	Quote       string   `json:"quote,omitempty"`
+}
+
+// Quiz is a stored set of questions generated for a user from a document
+type Quiz struct {
+	ID         string         `json:"id"`
+	DocumentID string         `json:"document_id"`
+	UserID     string         `json:"user_id"`
+	Difficulty string         `json:"difficulty"`
+	Types      []string       `json:"types"`
+	Questions  []QuizQuestion `json:"questions"`
+	CreatedAt  time.Time      `json:"created_at"`
+}
+
+type QuizRequest struct {
+	UserID     string   `json:"user_id" binding:"required"`
+	Count      int      `json:"count,omitempty"`
+	Difficulty string   `json:"difficulty,omitempty"`
+	Types      []string `json:"types,omitempty"`
+}
+
+// Fill in default quiz options and validate them
+func normalizeQuizRequest(req *QuizRequest) error {
+	if req.Count == 0 {
+		req.Count = defaultQuizCount
+	}
+	if req.Difficulty == "" {
+		req.Difficulty = "medium"
+	}
+	if len(req.Types) == 0 {
+		req.Types = []string{quizMultipleChoice, quizShortAnswer}
+	}
+
+	if req.Count < 1 || req.Count > maxQuizCount {
+		return fmt.Errorf("count must be between 1 and %d", maxQuizCount)
+	}
+	if _, ok := quizDifficulties[req.Difficulty]; !ok {
+		return fmt.Errorf("difficulty must be one of easy, medium or hard")
+	}
+	for _, t := range req.Types {
+		if t != quizMultipleChoice && t != quizShortAnswer {
+			return fmt.Errorf("types must be multiple_choice and/or short_answer")
+		}
+	}
+	return nil
+}
+
+// Parse the model's quiz output, checking the parts the schema can't express.
+// Questions must cite a chunk in pages, the chunks that were in the prompt,
+// and are given that chunk's page number.
+func parseQuizOutput(output string, types []string, pages map[int]int) ([]QuizQuestion, []string) {
+	var data interface{}
+	if err := json.Unmarshal([]byte(stripCodeFence(output)), &data); err != nil {
+		return nil, []string{"output is not valid JSON: " + err.Error()}
+	}
+	if errs := validateJSONSchema(quizOutputSchema, data); len(errs) > 0 {
+		return nil, errs
+	}
+
+	var parsed struct {
+		Questions []struct {
+			Type        string   `json:"type"`
+			Question    string   `json:"question"`
+			Options     []string `json:"options"`
+			Answer      string   `json:"answer"`
+			Explanation string   `json:"explanation"`
+			Chunk       int      `json:"chunk"`
+			Quote       string   `json:"quote"`
+		} `json:"questions"`
+	}
+	if err := json.Unmarshal([]byte(stripCodeFence(output)), &parsed); err != nil {
+		return nil, []string{"output is not valid JSON: " + err.Error()}
+	}
+
+	allowed := make(map[string]bool, len(types))
+	for _, t := range types {
+		allowed[t] = true
+	}
+
+	var errs []string
+	questions := make([]QuizQuestion, 0, len(parsed.Questions))
+	for i, q := range parsed.Questions {
+		path := fmt.Sprintf("$.questions[%d]", i)
+		if !allowed[q.Type] {
+			errs = append(errs, fmt.Sprintf("%s: type %s was not requested", path, q.Type))
+		}
+		if q.Type == quizMultipleChoice {
+			if len(q.Options) < 3 {
+				errs = append(errs, path+": multiple choice questions need at least 3 options")
+			}
+			found := false
+			for _, option := range q.Options {
+				if option == q.Answer {
+					found = true
+				}
+			}
+			if !found {
+				errs = append(errs, path+": answer must be one of the options")
+			}
+		}
+		page, ok := pages[q.Chunk]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s: cites chunk %d, which is not in the document", path, q.Chunk))
+		}
+
+		questions = append(questions, QuizQuestion{
+			Type:        q.Type,
+			Question:    q.Question,
+			Options:     q.Options,
+			Answer:      q.Answer,
+			Explanation: q.Explanation,
+			ChunkIndex:  q.Chunk,
+			PageNumber:  page,
+			Quote:       q.Quote,
+		})
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return questions, nil
+}
+
+// Write a quiz over a document's content
+func generateQuiz(ctx context.Context, documentID string, req QuizRequest) (*Quiz, error) {
+	chunks, err := getOrderedChunks(ctx, documentID)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, fmt.Errorf("no content found for this document")
+	}
+
+	typeNames := map[string]string{
+		quizMultipleChoice: "multiple choice (3 to 5 options, exactly one correct; the answer must repeat the correct option verbatim)",
+		quizShortAnswer:    "short answer (the answer is a word, phrase or one sentence)",
+	}
+	var allowed []string
+	for _, t := range req.Types {
+		allowed = append(allowed, fmt.Sprintf(`"%s": %s`, t, typeNames[t]))
+	}
+
+	instructions := fmt.Sprintf(`Write a study quiz of %d questions on the document below.
+%s
+Question types to use, mixed evenly:
+- %s
+
+Every question must be answerable from the document alone. Give a one-sentence explanation of each answer, and cite the chunk the answer comes from using the chunk number in the [chunk N, page P] markers, with a short verbatim quote.
+
+Return a JSON object of the form:
+{"questions": [{"type": "<question type>", "question": "...", "options": ["..."], "answer": "...", "explanation": "...", "chunk": <chunk number>, "quote": "<verbatim text>"}]}
+
+Omit "options" for short answer questions.
+
+Document:
+`, req.Count, quizDifficulties[req.Difficulty], strings.Join(allowed, "\n- "))
+
+	// Sample the whole document down to what fits beside the instructions
+	budget := budgetForModel(provider.Model())
+	contextTokens := budget.contextTokens(estimator.CountTokens(instructions))
+	sampled := sampleChunks(estimator, chunks, contextTokens)
+	content, included := formatCitableChunks(sampled, contextTokens)
+	if len(included) == 0 {
+		return nil, fmt.Errorf("document chunks don't fit the context budget")
+	}
+	if dropped := len(sampled) - len(included); dropped > 0 {
+		log.Printf("Quiz for document %s left out %d of %d sampled chunks to fit the context budget", documentID, dropped, len(sampled))
+	}
+	prompt := instructions + content
+
+	pages := make(map[int]int, len(included))
+	for _, chunk := range included {
+		pages[chunk.ChunkIndex] = chunk.PageNumber
+	}
+
+	var errs []string
+	for attempt := 0; attempt <= quizRepairAttempts; attempt++ {
+		output, err := provider.GenerateJSON(ctx, prompt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get response from AI: %v", err)
+		}
+
+		var questions []QuizQuestion
+		questions, errs = parseQuizOutput(output, req.Types, pages)
+		if len(errs) == 0 {
+			if len(questions) > req.Count {
+				questions = questions[:req.Count]
+			}
+
+			return &Quiz{
+				ID:         uuid.New().String(),
+				DocumentID: documentID,
+				UserID:     req.UserID,
+				Difficulty: req.Difficulty,
+				Types:      req.Types,
+				Questions:  questions,
+				CreatedAt:  time.Now(),
+			}, nil
+		}
+
+		log.Printf("Quiz attempt %d for document %s failed validation: %s", attempt+1, documentID, strings.Join(errs, "; "))
+
+		prompt = fmt.Sprintf(`Your previous quiz did not have the required format.
+
+Previous output:
+%s
+
+Problems:
+- %s
+
+Return the corrected JSON object of the form {"questions": [...]}, using only information from the document:
+%s`, output, strings.Join(errs, "\n- "), content)
+	}
+
+	return nil, fmt.Errorf("quiz failed validation: %s", strings.Join(errs, "; "))
+}
+
+// Store a quiz
+func saveQuiz(ctx context.Context, quiz *Quiz) error {
+	questions, err := json.Marshal(quiz.Questions)
+	if err != nil {
+		return fmt.Errorf("failed to encode questions: %v", err)
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO quizzes (id, document_id, user_id, difficulty, types, questions, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		quiz.ID, quiz.DocumentID, quiz.UserID, quiz.Difficulty, pq.Array(quiz.Types), string(questions), quiz.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save quiz: %v", err)
+	}
+	return nil
+}
+
+const quizColumns = "id, document_id, user_id, difficulty, types, questions, created_at"
+
+// Scan a quizzes row selected with quizColumns
+func scanQuiz(row rowScanner) (*Quiz, error) {
+	var quiz Quiz
+	var questions string
+	if err := row.Scan(&quiz.ID, &quiz.DocumentID, &quiz.UserID, &quiz.Difficulty, pq.Array(&quiz.Types), &questions, &quiz.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(questions), &quiz.Questions); err != nil {
+		return nil, fmt.Errorf("failed to decode questions: %v", err)
+	}
+	return &quiz, nil
+}
+
+// Generate and store a quiz for a user
+func quizHandler(c *gin.Context) {
+	documentID := c.Param("documentId")
+
+	var req QuizRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	if err := normalizeQuizRequest(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	var documentExists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM documents WHERE id = $1)", documentID).Scan(&documentExists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to verify document: " + err.Error(),
+		})
+		return
+	}
+
+	if !documentExists {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Success: false,
+			Error:   "Document not found",
+		})
+		return
+	}
+
+	quiz, err := generateQuiz(c.Request.Context(), documentID, req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to generate quiz: " + err.Error(),
+		})
+		return
+	}
+
+	if err := saveQuiz(c.Request.Context(), quiz); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"quiz":    quiz,
+	})
+}
+
+// List a user's quizzes for a document, newest first
+func listQuizzesHandler(c *gin.Context) {
+	documentID := c.Param("documentId")
+	userID := c.Query("userId")
+
+	if userID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "userId query parameter is required",
+		})
+		return
+	}
+
+	rows, err := db.Query("SELECT "+quizColumns+" FROM quizzes WHERE document_id = $1 AND user_id = $2 ORDER BY created_at DESC", documentID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to fetch quizzes: " + err.Error(),
+		})
+		return
+	}
+	defer rows.Close()
+
+	quizzes := []*Quiz{}
+	for rows.Next() {
+		quiz, err := scanQuiz(rows)
+		if err != nil {
+			log.Printf("Error scanning quiz: %v", err)
+			continue
+		}
+		quizzes = append(quizzes, quiz)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"quizzes": quizzes,
+	})
+}
+
+// Fetch a stored quiz, writing the error response on failure
+func loadQuizForRequest(c *gin.Context) (*Quiz, bool) {
+	quiz, err := scanQuiz(db.QueryRow("SELECT "+quizColumns+" FROM quizzes WHERE id = $1", c.Param("quizId")))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Success: false,
+			Error:   "Quiz not found",
+		})
+		return nil, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to fetch quiz: " + err.Error(),
+		})
+		return nil, false
+	}
+	return quiz, true
+}
+
+// Fetch a stored quiz
+func getQuizHandler(c *gin.Context) {
+	quiz, ok := loadQuizForRequest(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"quiz":    quiz,
+	})
+}
+
+// Export a quiz as flashcards Anki can import: front, back and tags, as CSV
+// or tab-separated text. Newlines become <br> since Anki fields allow HTML.
+func flashcardsHandler(c *gin.Context) {
+	format := c.DefaultQuery("format", "tsv")
+	if format != "csv" && format != "tsv" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "format must be csv or tsv",
+		})
+		return
+	}
+
+	quiz, ok := loadQuizForRequest(c)
+	if !ok {
+		return
+	}
+
+	contentType := "text/csv"
+	if format == "tsv" {
+		contentType = "text/tab-separated-values"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="flashcards-%s.%s"`, quiz.ID, format))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	if format == "tsv" {
+		w.Comma = '\t'
+		fmt.Fprintf(c.Writer, "#separator:tab\n#html:true\n#tags column:3\n")
+	} else {
+		fmt.Fprintf(c.Writer, "#separator:comma\n#html:true\n#tags column:3\n")
+	}
+
+	tags := "docsy " + quiz.Difficulty
+	for _, q := range quiz.Questions {
+		front := q.Question
+		for i, option := range q.Options {
+			front += fmt.Sprintf("\n%c. %s", 'A'+i, option)
+		}
+
+		back := q.Answer
+		if q.Explanation != "" {
+			back += "\n\n" + q.Explanation
+		}
+		if q.PageNumber > 0 {
+			back += fmt.Sprintf("\n\n(page %d)", q.PageNumber)
+		}
+
+		w.Write([]string{ankiField(front), ankiField(back), tags + " " + q.Type})
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Printf("Error writing flashcard export: %v", err)
+	}
+}
+
+// Make text safe for an HTML-enabled Anki field
+func ankiField(text string) string {
+	text = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+	return strings.ReplaceAll(text, "\n", "<br>")
+}
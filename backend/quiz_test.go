@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseQuizOutputCitations(t *testing.T) {
+	types := []string{quizShortAnswer}
+	pages := map[int]int{0: 1, 3: 2}
+
+	questions, errs := parseQuizOutput(`{"questions": [{"type": "short_answer", "question": "When does the lease end?", "answer": "31 March 2030", "chunk": 3}]}`, types, pages)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(questions) != 1 || questions[0].PageNumber != 2 {
+		t.Errorf("questions = %+v, want one citing chunk 3 on page 2", questions)
+	}
+
+	// Chunk 5 exists in the document but wasn't in the prompt
+	_, errs = parseQuizOutput(`{"questions": [{"type": "short_answer", "question": "Who is the tenant?", "answer": "Acme Ltd", "chunk": 5}]}`, types, pages)
+	if len(errs) != 1 || !strings.Contains(errs[0], "chunk 5") {
+		t.Errorf("errs = %v, want one error about chunk 5", errs)
+	}
+}
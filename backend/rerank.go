@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Number of first-stage candidates passed to the reranker
+const rerankCandidates = 40
+
+// Passages longer than this are cut before being sent to the LLM reranker
+const llmRerankMaxPassageRunes = 800
+
+// Reranker reorders first-stage retrieval results by relevance to the query.
+// Implementations set RerankScore and Score on each chunk and return the
+// chunks sorted by descending score.
+type Reranker interface {
+	Rerank(ctx context.Context, query string, chunks []RetrievedChunk) ([]RetrievedChunk, error)
+}
+
+// Configured reranker, nil when reranking is disabled
+var reranker Reranker
+
+// Create the reranker selected by name: "llm", "lexical" or "" for none
+func newReranker(name string) Reranker {
+	switch strings.ToLower(name) {
+	case "":
+		return nil
+	case "llm":
+		return LLMReranker{}
+	case "lexical":
+		return LexicalReranker{K1: 1.2, B: 0.75}
+	default:
+		log.Printf("Unknown reranker %q, reranking disabled", name)
+		return nil
+	}
+}
+
+// Run a reranker, keeping the first-stage order if it fails
+func rerankChunks(ctx context.Context, r Reranker, query string, chunks []RetrievedChunk) []RetrievedChunk {
+	for i := range chunks {
+		chunks[i].RetrievalScore = chunks[i].Score
+	}
+
+	reranked, err := r.Rerank(ctx, query, chunks)
+	if err != nil {
+		log.Printf("Error reranking chunks, keeping retrieval order: %v", err)
+		return chunks
+	}
+	return reranked
+}
+
+// Sort chunks by descending score
+func sortByScore(chunks []RetrievedChunk) {
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].Score > chunks[j].Score
+	})
+}
+
+// Parts of the rerank prompt that FakeProvider recognises it by: the passage
+// markers and the output format
+const (
+	rerankPassageFormat = "[%d] %s\n\n"
+	rerankOutputFormat  = `{"index": <passage number>, "score": <0 to 10>}`
+)
+
+// Passage markers written with rerankPassageFormat
+var rerankPassagePattern = regexp.MustCompile(`(?m)^\[(\d+)\] `)
+
+// LLMReranker asks the LLM to grade each passage's relevance to the query,
+// scoring all candidates in a single call.
+type LLMReranker struct{}
+
+func (LLMReranker) Rerank(ctx context.Context, query string, chunks []RetrievedChunk) ([]RetrievedChunk, error) {
+	var passages strings.Builder
+	for i, chunk := range chunks {
+		content := []rune(chunk.Content)
+		if len(content) > llmRerankMaxPassageRunes {
+			content = content[:llmRerankMaxPassageRunes]
+		}
+		fmt.Fprintf(&passages, rerankPassageFormat, i, string(content))
+	}
+
+	prompt := fmt.Sprintf(`You are grading document passages by how useful they are for answering a question.
+
+`+stageQuestionLabel+`%s
+
+Passages:
+%s
+Return a JSON array with one object per passage, in the form `+rerankOutputFormat+`, where 10 means the passage directly answers the question and 0 means it is unrelated.`, query, passages.String())
+
+	response, err := provider.GenerateJSON(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	var grades []struct {
+		Index int     `json:"index"`
+		Score float64 `json:"score"`
+	}
+	if err := json.Unmarshal([]byte(response), &grades); err != nil {
+		return nil, fmt.Errorf("failed to parse rerank scores: %v", err)
+	}
+
+	reranked := make([]RetrievedChunk, len(chunks))
+	copy(reranked, chunks)
+	for i := range reranked {
+		reranked[i].RerankScore = 0
+		reranked[i].Score = 0
+	}
+	for _, grade := range grades {
+		if grade.Index < 0 || grade.Index >= len(reranked) {
+			continue
+		}
+		reranked[grade.Index].RerankScore = grade.Score / 10
+		reranked[grade.Index].Score = grade.Score / 10
+	}
+
+	sortByScore(reranked)
+	return reranked, nil
+}
+
+// LexicalReranker scores passages with BM25 over the candidate set plus a
+// bonus for containing the query verbatim. It needs no network access.
+type LexicalReranker struct {
+	K1 float64
+	B  float64
+}
+
+func (r LexicalReranker) Rerank(ctx context.Context, query string, chunks []RetrievedChunk) ([]RetrievedChunk, error) {
+	queryTerms := tokenize(query)
+	if len(queryTerms) == 0 || len(chunks) == 0 {
+		return chunks, nil
+	}
+
+	docs := make([][]string, len(chunks))
+	docFreq := make(map[string]int)
+	totalLength := 0
+	for i, chunk := range chunks {
+		docs[i] = tokenize(chunk.Content)
+		totalLength += len(docs[i])
+
+		seen := make(map[string]bool)
+		for _, term := range docs[i] {
+			if !seen[term] {
+				seen[term] = true
+				docFreq[term]++
+			}
+		}
+	}
+	avgLength := float64(totalLength) / float64(len(chunks))
+	phrase := strings.ToLower(strings.TrimSpace(query))
+
+	reranked := make([]RetrievedChunk, len(chunks))
+	copy(reranked, chunks)
+	for i := range reranked {
+		termFreq := make(map[string]int)
+		for _, term := range docs[i] {
+			termFreq[term]++
+		}
+
+		score := 0.0
+		for _, term := range queryTerms {
+			tf := float64(termFreq[term])
+			if tf == 0 {
+				continue
+			}
+			n := float64(len(chunks))
+			df := float64(docFreq[term])
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			norm := 1 - r.B + r.B*float64(len(docs[i]))/avgLength
+			score += idf * tf * (r.K1 + 1) / (tf + r.K1*norm)
+		}
+
+		if len(queryTerms) > 1 && strings.Contains(strings.ToLower(reranked[i].Content), phrase) {
+			score *= 1.5
+		}
+
+		reranked[i].RerankScore = score
+		reranked[i].Score = score
+	}
+
+	sortByScore(reranked)
+	return reranked, nil
+}
+
+// Split text into lowercase word and number tokens
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
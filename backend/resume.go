@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Conversation frames kept per conversation for replay on reconnect
+const replayBufferSize = 128
+
+// Most stored messages replayed from the database on reconnect
+const replayMessageLimit = 100
+
+// How long an idle conversation's frames are kept in memory
+const replayRetention = 10 * time.Minute
+
+// How long in-flight queries keep running after the last connection of their
+// conversation drops, so a client that reconnects in time still gets the
+// answer
+const resumeGracePeriod = 30 * time.Second
+
+// A conversation is one user's chat about one document. All of the user's
+// connections to the document receive its frames.
+func conversationKey(documentID, userID string) string {
+	return documentID + "/" + userID
+}
+
+// Conversation sequence numbers are microsecond timestamps, bumped where
+// needed to stay strictly increasing. That keeps them increasing across
+// restarts. A single instance counts them in memory; with several instances
+// the backplane hands them out from one shared counter per conversation, so
+// clock skew between instances can't send them backwards.
+var sequences = struct {
+	sync.Mutex
+	last map[string]int64
+}{last: make(map[string]int64)}
+
+// Attempts at getting a sequence number from the backplane, and how long
+// each may take
+const (
+	sequenceAttempts = 3
+	sequenceTimeout  = 2 * time.Second
+)
+
+// Next sequence number for a conversation, from the backplane if it has a
+// shared counter. The local counter isn't a fallback for a failing shared
+// one: mixing the two could send sequence numbers backwards.
+func nextSeq(key string) (int64, error) {
+	sequencer, ok := hub.backplane.(Sequencer)
+	if !ok {
+		return localSeq(key), nil
+	}
+
+	var err error
+	for attempt := 0; attempt < sequenceAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), sequenceTimeout)
+		var seq int64
+		seq, err = sequencer.NextSeq(ctx, key)
+		cancel()
+		if err == nil {
+			return seq, nil
+		}
+	}
+	return 0, err
+}
+
+// Next sequence number for a conversation from this instance's counter
+func localSeq(key string) int64 {
+	sequences.Lock()
+	defer sequences.Unlock()
+
+	seq := time.Now().UnixMicro()
+	if last := sequences.last[key]; seq <= last {
+		seq = last + 1
+	}
+	sequences.last[key] = seq
+	return seq
+}
+
+// conversationLog holds the most recent frames of a conversation. It has
+// every frame with a sequence number above since.
+type conversationLog struct {
+	frames  []WSResponse
+	since   int64
+	updated time.Time
+}
+
+// Record a conversation frame, dropping the oldest once the buffer is full
+func (l *conversationLog) add(response WSResponse) {
+	if len(l.frames) == replayBufferSize {
+		l.since = l.frames[0].Seq
+		l.frames = l.frames[1:]
+	}
+	l.frames = append(l.frames, response)
+	l.updated = time.Now()
+}
+
+// Frames after lastSeq, and whether the buffer still has all of them
+func (l *conversationLog) after(lastSeq int64) ([]WSResponse, bool) {
+	if l == nil || lastSeq < l.since {
+		return nil, false
+	}
+	var frames []WSResponse
+	for _, frame := range l.frames {
+		if frame.Seq > lastSeq {
+			frames = append(frames, frame)
+		}
+	}
+	return frames, true
+}
+
+// Load the stored messages of a conversation after lastSeq as message
+// frames. Used when the in-memory buffer no longer covers the gap, e.g.
+// after a restart or on another instance. Only the most recent messages are
+// returned; a client that missed more should refetch the history.
+func loadReplay(ctx context.Context, documentID, userID string, lastSeq int64) ([]WSResponse, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, message_type, message_content, timestamp, COALESCE(prompt_template, ''), COALESCE(model, ''),
+			cancelled, COALESCE(parent_id, ''), COALESCE(client_message_id, ''), seq
+		FROM chat_messages
+		WHERE document_id = $1 AND user_id = $2 AND seq > $3
+		ORDER BY seq DESC
+		LIMIT $4`, documentID, userID, lastSeq, replayMessageLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch missed messages: %v", err)
+	}
+	defer rows.Close()
+
+	var frames []WSResponse
+	for rows.Next() {
+		msg := ChatMessage{DocumentID: documentID, UserID: userID}
+		err := rows.Scan(&msg.ID, &msg.MessageType, &msg.MessageContent, &msg.Timestamp, &msg.PromptTemplate,
+			&msg.Model, &msg.Cancelled, &msg.ParentID, &msg.ClientMessageID, &msg.Seq)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan missed message: %v", err)
+		}
+		frames = append(frames, WSResponse{
+			Type:      wsMessage,
+			ID:        msg.ID,
+			Seq:       msg.Seq,
+			Timestamp: msg.Timestamp.Format(time.RFC3339),
+			Message:   &msg,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to fetch missed messages: %v", err)
+	}
+
+	// Oldest first
+	for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+		frames[i], frames[j] = frames[j], frames[i]
+	}
+	return frames, nil
+}
+
+// Send a reconnecting client the conversation frames it missed: from the
+// buffer if it covers the gap, otherwise the stored messages followed by any
+// buffered frames newer than them. Must only be called from run.
+func (h *Hub) replay(client *Client) {
+	if client.lastSeq == 0 {
+		return
+	}
+
+	buffer := h.history[conversationKey(client.documentID, client.userID)]
+	frames, ok := buffer.after(client.lastSeq)
+	if !ok {
+		frames = client.stored
+		if buffer != nil {
+			lastSeq := client.lastSeq
+			if len(frames) > 0 {
+				lastSeq = frames[len(frames)-1].Seq
+			}
+			buffered, _ := (&conversationLog{frames: buffer.frames}).after(lastSeq)
+			frames = append(frames, buffered...)
+		}
+	}
+
+	for _, frame := range frames {
+		// Stop if the replay overflowed the client's buffer and evicted it
+		if !h.clients[client] {
+			return
+		}
+		h.send(client, frame)
+	}
+}
+
+// Drop the buffers of conversations with no recent frames, and their
+// sequence counters. Must only be called from run.
+func (h *Hub) pruneHistory() {
+	for key, buffer := range h.history {
+		if time.Since(buffer.updated) > replayRetention {
+			delete(h.history, key)
+		}
+	}
+
+	// Sequence numbers are timestamps, so a counter this far behind the
+	// clock can no longer hold a new one back
+	cutoff := time.Now().Add(-replayRetention).UnixMicro()
+	sequences.Lock()
+	defer sequences.Unlock()
+	for key, last := range sequences.last {
+		if last < cutoff {
+			delete(sequences.last, key)
+		}
+	}
+}
+
+// Next sequence number for the client's conversation, or 0 if none can be
+// had. Frames and messages without one aren't replayed.
+func (c *Client) nextSeq() int64 {
+	seq, err := nextSeq(conversationKey(c.documentID, c.userID))
+	if err != nil {
+		log.Printf("Error getting sequence number, continuing without one: %v", err)
+	}
+	return seq
+}
+
+// Send a frame to every connection in the client's conversation, on every
+// instance, assigning it a sequence number if it has none. A frame that
+// can't get one is still sent, but without a seq, so it can't be replayed.
+// Returns the sequence number.
+func (c *Client) sendToConversation(response WSResponse) int64 {
+	if response.Seq == 0 {
+		response.Seq = c.nextSeq()
+	}
+	hub.publish(DocumentEvent{DocumentID: c.documentID, UserID: c.userID, Response: response})
+	return response.Seq
+}
+
+// Send a chunk of a streaming answer to the client's conversation. Chunks
+// have no seq and aren't replayed; the response frame carries the whole
+// answer.
+func (c *Client) streamToConversation(response WSResponse) {
+	hub.publish(DocumentEvent{DocumentID: c.documentID, UserID: c.userID, Response: response})
+}
+
+// An in-flight query
+type inflightQuery struct {
+	cancel context.CancelFunc
+}
+
+// The in-flight queries of a conversation and its open connections on this
+// instance. Queries belong to the conversation rather than the connection
+// that started them, so a reconnected client keeps them alive and can
+// cancel them.
+type conversationQueries struct {
+	connections int
+	idleSince   time.Time
+	queries     map[string]*inflightQuery
+}
+
+var conversations = struct {
+	sync.Mutex
+	byKey map[string]*conversationQueries
+}{byKey: make(map[string]*conversationQueries)}
+
+// Look up a conversation's queries, creating the entry. The caller holds
+// the lock.
+func lookupConversation(key string) *conversationQueries {
+	conversation := conversations.byKey[key]
+	if conversation == nil {
+		conversation = &conversationQueries{queries: make(map[string]*inflightQuery)}
+		conversations.byKey[key] = conversation
+	}
+	return conversation
+}
+
+// Drop a conversation's entry once nothing refers to it. The caller holds
+// the lock.
+func releaseConversation(key string, conversation *conversationQueries) {
+	if conversation.connections == 0 && len(conversation.queries) == 0 {
+		delete(conversations.byKey, key)
+	}
+}
+
+// Record a connection opening in a conversation
+func joinConversation(key string) {
+	conversations.Lock()
+	defer conversations.Unlock()
+	lookupConversation(key).connections++
+}
+
+// Record a connection closing. Once the conversation has had no connections
+// for the resume grace period, its in-flight queries are cancelled.
+func leaveConversation(key string) {
+	conversations.Lock()
+	defer conversations.Unlock()
+
+	conversation := lookupConversation(key)
+	conversation.connections--
+	if conversation.connections > 0 {
+		return
+	}
+	conversation.idleSince = time.Now()
+	if len(conversation.queries) > 0 {
+		time.AfterFunc(resumeGracePeriod, func() { expireConversation(key) })
+	}
+	releaseConversation(key, conversation)
+}
+
+// Cancel a conversation's queries if no connection has joined it since the
+// grace period started
+func expireConversation(key string) {
+	conversations.Lock()
+	defer conversations.Unlock()
+
+	conversation := conversations.byKey[key]
+	if conversation == nil || conversation.connections > 0 || time.Since(conversation.idleSince) < resumeGracePeriod {
+		return
+	}
+	for _, query := range conversation.queries {
+		query.cancel()
+	}
+}
+
+// Register an in-flight query and return its context, which is cancelled
+// by a cancel message from any of the conversation's connections, or once
+// the conversation has had no connections for the resume grace period.
+// A query already running under the same request ID is cancelled.
+func startQuery(key, requestID string) (context.Context, *inflightQuery) {
+	ctx, cancel := context.WithCancel(context.Background())
+	query := &inflightQuery{cancel: cancel}
+
+	conversations.Lock()
+	defer conversations.Unlock()
+	conversation := lookupConversation(key)
+	if previous, ok := conversation.queries[requestID]; ok {
+		previous.cancel()
+	}
+	conversation.queries[requestID] = query
+	return ctx, query
+}
+
+// Release a finished query
+func finishQuery(key, requestID string, query *inflightQuery) {
+	query.cancel()
+
+	conversations.Lock()
+	defer conversations.Unlock()
+	conversation := lookupConversation(key)
+	if conversation.queries[requestID] == query {
+		delete(conversation.queries, requestID)
+	}
+	releaseConversation(key, conversation)
+}
+
+// Cancel an in-flight query of a conversation, reporting whether it was found
+func cancelQuery(key, requestID string) bool {
+	conversations.Lock()
+	defer conversations.Unlock()
+	conversation := conversations.byKey[key]
+	if conversation == nil {
+		return false
+	}
+	query, ok := conversation.queries[requestID]
+	if ok {
+		query.cancel()
+	}
+	return ok
+}
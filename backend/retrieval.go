@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/lib/pq"
+)
+
+// Number of chunks used as context for a query
+const retrievalTopK = 20
+
+// Number of candidates taken from each first-stage retriever before fusion
+const retrievalCandidates = 50
+
+// FusionWeights controls how vector and keyword rankings are combined with
+// reciprocal rank fusion: score = Σ weight / (K + rank).
+type FusionWeights struct {
+	Vector  float64
+	Keyword float64
+	K       float64
+}
+
+// Fusion weights for hybrid retrieval, loaded at startup
+var fusionWeights = FusionWeights{Vector: 1, Keyword: 1, K: 60}
+
+// Load fusion weights from the environment
+func loadFusionWeights() FusionWeights {
+	return FusionWeights{
+		Vector:  cfg.RetrievalVectorWeight,
+		Keyword: cfg.RetrievalKeywordWeight,
+		K:       cfg.RetrievalRRFK,
+	}
+}
+
+// ChunkFilter restricts a similarity search to a set of documents or a collection
+type ChunkFilter struct {
+	DocumentIDs []string
+	Collection  string
+	UserID      string
+}
+
+// RetrievedChunk is a document chunk ranked against a query
+type RetrievedChunk struct {
+	ID         string  `json:"id"`
+	DocumentID string  `json:"document_id"`
+	ChunkIndex int     `json:"chunk_index"`
+	PageNumber int     `json:"page_number,omitempty"`
+	Content    string  `json:"content"`
+	Score      float64 `json:"score"`
+
+	// First-stage scores, set by hybrid retrieval
+	VectorScore  float64 `json:"vector_score,omitempty"`
+	KeywordScore float64 `json:"keyword_score,omitempty"`
+
+	// Scores before and after reranking, set when a reranker is configured
+	RetrievalScore float64 `json:"retrieval_score,omitempty"`
+	RerankScore    float64 `json:"rerank_score,omitempty"`
+}
+
+// Search for the chunks most similar to a query embedding
+func searchSimilarChunks(ctx context.Context, queryEmbedding []float32, filter ChunkFilter, limit int) ([]RetrievedChunk, error) {
+	if pgvectorEnabled {
+		return searchSimilarChunksSQL(ctx, queryEmbedding, filter, limit)
+	}
+	return searchSimilarChunksInProcess(ctx, queryEmbedding, filter, limit)
+}
+
+// Similarity search using the pgvector index
+func searchSimilarChunksSQL(ctx context.Context, queryEmbedding []float32, filter ChunkFilter, limit int) ([]RetrievedChunk, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.id, c.document_id, c.chunk_index, COALESCE(c.page_number, 0), c.content, 1 - (c.embedding_vector <=> $1::vector) AS score
+		FROM document_chunks c
+		JOIN documents d ON d.id = c.document_id
+		WHERE c.embedding_vector IS NOT NULL
+			AND (cardinality($2::text[]) = 0 OR c.document_id = ANY($2))
+			AND ($3 = '' OR d.collection = $3)
+			AND ($4 = '' OR d.user_id = $4)
+		ORDER BY c.embedding_vector <=> $1::vector
+		LIMIT $5`,
+		formatVector(queryEmbedding), pq.Array(filter.DocumentIDs), filter.Collection, filter.UserID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search chunks: %v", err)
+	}
+	defer rows.Close()
+
+	var chunks []RetrievedChunk
+	for rows.Next() {
+		var chunk RetrievedChunk
+		if err := rows.Scan(&chunk.ID, &chunk.DocumentID, &chunk.ChunkIndex, &chunk.PageNumber, &chunk.Content, &chunk.Score); err != nil {
+			return nil, fmt.Errorf("failed to scan chunk: %v", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, rows.Err()
+}
+
+// Similarity search over BYTEA embeddings, used when pgvector isn't installed
+func searchSimilarChunksInProcess(ctx context.Context, queryEmbedding []float32, filter ChunkFilter, limit int) ([]RetrievedChunk, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.id, c.document_id, c.chunk_index, COALESCE(c.page_number, 0), c.content, c.embedding
+		FROM document_chunks c
+		JOIN documents d ON d.id = c.document_id
+		WHERE c.embedding IS NOT NULL
+			AND (cardinality($1::text[]) = 0 OR c.document_id = ANY($1))
+			AND ($2 = '' OR d.collection = $2)
+			AND ($3 = '' OR d.user_id = $3)`,
+		pq.Array(filter.DocumentIDs), filter.Collection, filter.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load chunk embeddings: %v", err)
+	}
+	defer rows.Close()
+
+	var chunks []RetrievedChunk
+	for rows.Next() {
+		var chunk RetrievedChunk
+		var embedding []byte
+		if err := rows.Scan(&chunk.ID, &chunk.DocumentID, &chunk.ChunkIndex, &chunk.PageNumber, &chunk.Content, &embedding); err != nil {
+			return nil, fmt.Errorf("failed to scan chunk: %v", err)
+		}
+		chunk.Score = cosineSimilarity(queryEmbedding, decodeEmbedding(embedding))
+		chunks = append(chunks, chunk)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].Score > chunks[j].Score
+	})
+	if len(chunks) > limit {
+		chunks = chunks[:limit]
+	}
+
+	return chunks, nil
+}
+
+// Keyword search over the chunk full-text index. Query terms are OR-ed so a
+// chunk matching a single identifier still ranks; ts_rank_cd with length
+// normalisation gives a BM25-style score.
+func searchKeywordChunks(ctx context.Context, query string, filter ChunkFilter, limit int) ([]RetrievedChunk, error) {
+	rows, err := db.QueryContext(ctx, `
+		WITH q AS (
+			SELECT to_tsquery('english', replace(plainto_tsquery('english', $1)::text, ' & ', ' | ')) AS query
+		)
+		SELECT c.id, c.document_id, c.chunk_index, COALESCE(c.page_number, 0), c.content, ts_rank_cd(c.content_tsv, q.query, 1) AS score
+		FROM document_chunks c
+		JOIN documents d ON d.id = c.document_id, q
+		WHERE c.content_tsv @@ q.query
+			AND (cardinality($2::text[]) = 0 OR c.document_id = ANY($2))
+			AND ($3 = '' OR d.collection = $3)
+			AND ($4 = '' OR d.user_id = $4)
+		ORDER BY score DESC
+		LIMIT $5`,
+		query, pq.Array(filter.DocumentIDs), filter.Collection, filter.UserID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search chunks by keyword: %v", err)
+	}
+	defer rows.Close()
+
+	var chunks []RetrievedChunk
+	for rows.Next() {
+		var chunk RetrievedChunk
+		if err := rows.Scan(&chunk.ID, &chunk.DocumentID, &chunk.ChunkIndex, &chunk.PageNumber, &chunk.Content, &chunk.Score); err != nil {
+			return nil, fmt.Errorf("failed to scan chunk: %v", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, rows.Err()
+}
+
+// Combine vector and keyword rankings with weighted reciprocal rank fusion
+func fuseRankings(vectorChunks, keywordChunks []RetrievedChunk, weights FusionWeights, limit int) []RetrievedChunk {
+	fused := make(map[string]*RetrievedChunk)
+	var order []string
+
+	add := func(chunk RetrievedChunk) *RetrievedChunk {
+		if existing, ok := fused[chunk.ID]; ok {
+			return existing
+		}
+		chunk.Score = 0
+		fused[chunk.ID] = &chunk
+		order = append(order, chunk.ID)
+		return &chunk
+	}
+
+	for rank, chunk := range vectorChunks {
+		score := chunk.Score
+		entry := add(chunk)
+		entry.VectorScore = score
+		entry.Score += weights.Vector / (weights.K + float64(rank+1))
+	}
+	for rank, chunk := range keywordChunks {
+		score := chunk.Score
+		entry := add(chunk)
+		entry.KeywordScore = score
+		entry.Score += weights.Keyword / (weights.K + float64(rank+1))
+	}
+
+	chunks := make([]RetrievedChunk, 0, len(order))
+	for _, id := range order {
+		chunks = append(chunks, *fused[id])
+	}
+
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].Score > chunks[j].Score
+	})
+	if len(chunks) > limit {
+		chunks = chunks[:limit]
+	}
+
+	return chunks
+}
+
+// Hybrid keyword + semantic search for one or more queries. The queries are
+// embedded in a single call, each query's vector and keyword rankings are
+// fused, and the per-query rankings are then merged. Either retriever may
+// come back empty (no embeddings, no matching terms); the other one then
+// decides the ranking.
+func searchHybridChunks(ctx context.Context, queries []string, filter ChunkFilter, limit int) ([]RetrievedChunk, error) {
+	embeddings, err := provider.Embed(ctx, queries)
+	if err == nil && len(embeddings) != len(queries) {
+		err = fmt.Errorf("got %d embeddings for %d queries", len(embeddings), len(queries))
+	}
+	if err != nil {
+		log.Printf("Error embedding query, using keyword search only: %v", err)
+		embeddings = nil
+	}
+
+	var rankings [][]RetrievedChunk
+	for i, query := range queries {
+		var vectorChunks []RetrievedChunk
+		if embeddings != nil {
+			vectorChunks, err = searchSimilarChunks(ctx, embeddings[i], filter, retrievalCandidates)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		keywordChunks, err := searchKeywordChunks(ctx, query, filter, retrievalCandidates)
+		if err != nil {
+			return nil, err
+		}
+
+		rankings = append(rankings, fuseRankings(vectorChunks, keywordChunks, fusionWeights, limit))
+	}
+
+	if len(rankings) == 1 {
+		return rankings[0], nil
+	}
+	return mergeRankings(rankings, fusionWeights.K, limit), nil
+}
+
+// Fetch all chunks of a document in reading order
+func getOrderedChunks(ctx context.Context, documentID string) ([]RetrievedChunk, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, document_id, chunk_index, COALESCE(page_number, 0), content FROM document_chunks WHERE document_id = $1 ORDER BY chunk_index", documentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch chunks: %v", err)
+	}
+	defer rows.Close()
+
+	var chunks []RetrievedChunk
+	for rows.Next() {
+		var chunk RetrievedChunk
+		if err := rows.Scan(&chunk.ID, &chunk.DocumentID, &chunk.ChunkIndex, &chunk.PageNumber, &chunk.Content); err != nil {
+			log.Printf("Error scanning chunk: %v", err)
+			continue
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, rows.Err()
+}
+
+// Retrieve the chunks of a document that best answer a query. Paraphrases
+// after the first query add candidates; the fused candidates are reranked
+// once against the first query. If neither retriever finds anything the
+// chunks are returned in reading order.
+func retrieveChunks(ctx context.Context, documentID string, queries []string) ([]RetrievedChunk, error) {
+	limit := retrievalTopK
+	if reranker != nil {
+		limit = rerankCandidates
+	}
+
+	chunks, err := searchHybridChunks(ctx, queries, ChunkFilter{DocumentIDs: []string{documentID}}, limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return getOrderedChunks(ctx, documentID)
+	}
+
+	if reranker != nil {
+		chunks = rerankChunks(ctx, reranker, queries[0], chunks)
+		if len(chunks) > retrievalTopK {
+			chunks = chunks[:retrievalTopK]
+		}
+	}
+
+	if cfg.RetrievalDebug {
+		for rank, chunk := range chunks {
+			log.Printf("Retrieval debug: rank=%d chunk=%d page=%d score=%.4f vector=%.4f keyword=%.4f retrieval=%.4f rerank=%.4f",
+				rank+1, chunk.ChunkIndex, chunk.PageNumber, chunk.Score, chunk.VectorScore, chunk.KeywordScore, chunk.RetrievalScore, chunk.RerankScore)
+		}
+	}
+
+	return chunks, nil
+}
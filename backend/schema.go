@@ -2,9 +2,13 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 )
 
+// Whether the pgvector extension is available and document_chunks has a vector column
+var pgvectorEnabled bool
+
 // initSchema creates the necessary database tables if they don't already exist.
 func initSchema(db *sql.DB) {
 	// SQL statements to create tables
@@ -53,5 +57,171 @@ func initSchema(db *sql.DB) {
 		log.Fatalf("Failed to create database schema: %v", err)
 	}
 
+	// Columns added after the initial schema
+	migrationsSQL := `
+    ALTER TABLE documents ADD COLUMN IF NOT EXISTS collection VARCHAR(255);
+    ALTER TABLE documents ADD COLUMN IF NOT EXISTS prompt_template VARCHAR(100);
+    ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS prompt_template VARCHAR(100);
+    CREATE INDEX IF NOT EXISTS idx_documents_user_collection ON documents (user_id, collection);
+    CREATE INDEX IF NOT EXISTS idx_document_chunks_document ON document_chunks (document_id, chunk_index);
+    ALTER TABLE document_chunks ADD COLUMN IF NOT EXISTS page_number INT;
+    ALTER TABLE document_chunks ADD COLUMN IF NOT EXISTS content_tsv tsvector
+        GENERATED ALWAYS AS (to_tsvector('english', content)) STORED;
+    CREATE INDEX IF NOT EXISTS idx_document_chunks_content_tsv ON document_chunks USING GIN (content_tsv);
+
+    CREATE TABLE IF NOT EXISTS document_summaries (
+        id VARCHAR(36) PRIMARY KEY,
+        document_id VARCHAR(36) NOT NULL,
+        version VARCHAR(64) NOT NULL,
+        style VARCHAR(50) NOT NULL,
+        length VARCHAR(50) NOT NULL,
+        summary TEXT NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE (document_id, version, style, length),
+        FOREIGN KEY (document_id) REFERENCES documents(id) ON DELETE CASCADE
+    );
+
+    CREATE TABLE IF NOT EXISTS extraction_runs (
+        id VARCHAR(36) PRIMARY KEY,
+        document_id VARCHAR(36) NOT NULL,
+        user_id VARCHAR(255),
+        schema JSONB NOT NULL,
+        result JSONB,
+        citations JSONB NOT NULL DEFAULT '[]',
+        status VARCHAR(20) NOT NULL,
+        error TEXT,
+        attempts INT NOT NULL DEFAULT 0,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (document_id) REFERENCES documents(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS idx_extraction_runs_document ON extraction_runs (document_id, created_at);
+
+    CREATE TABLE IF NOT EXISTS extraction_batches (
+        id VARCHAR(36) PRIMARY KEY,
+        user_id VARCHAR(255) NOT NULL,
+        collection VARCHAR(255) NOT NULL,
+        schema JSONB NOT NULL,
+        status VARCHAR(20) NOT NULL,
+        total INT NOT NULL,
+        succeeded INT NOT NULL DEFAULT 0,
+        failed INT NOT NULL DEFAULT 0,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+        completed_at TIMESTAMP WITH TIME ZONE,
+        FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+    ALTER TABLE extraction_runs ADD COLUMN IF NOT EXISTS batch_id VARCHAR(36)
+        REFERENCES extraction_batches(id) ON DELETE CASCADE;
+    CREATE INDEX IF NOT EXISTS idx_extraction_runs_batch ON extraction_runs (batch_id);
+    ALTER TABLE extraction_runs ADD COLUMN IF NOT EXISTS dropped_chunks INT NOT NULL DEFAULT 0;
+    ALTER TABLE extraction_batches ADD COLUMN IF NOT EXISTS instance_id VARCHAR(36);
+    ALTER TABLE extraction_batches ADD COLUMN IF NOT EXISTS heartbeat_at TIMESTAMP WITH TIME ZONE;
+    DELETE FROM extraction_runs a USING extraction_runs b
+        WHERE a.batch_id = b.batch_id AND a.document_id = b.document_id AND a.id > b.id;
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_extraction_runs_batch_item ON extraction_runs (batch_id, document_id)
+        WHERE batch_id IS NOT NULL;
+
+    CREATE TABLE IF NOT EXISTS document_suggestions (
+        id VARCHAR(36) PRIMARY KEY,
+        document_id VARCHAR(36) NOT NULL,
+        position INT NOT NULL,
+        question TEXT NOT NULL,
+        version VARCHAR(64) NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (document_id) REFERENCES documents(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS idx_document_suggestions_document ON document_suggestions (document_id, position);
+
+    CREATE TABLE IF NOT EXISTS quizzes (
+        id VARCHAR(36) PRIMARY KEY,
+        document_id VARCHAR(36) NOT NULL,
+        user_id VARCHAR(255) NOT NULL,
+        difficulty VARCHAR(20) NOT NULL,
+        types TEXT[] NOT NULL,
+        questions JSONB NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY (document_id) REFERENCES documents(id) ON DELETE CASCADE,
+        FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS idx_quizzes_document_user ON quizzes (document_id, user_id, created_at);
+
+    ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS model VARCHAR(100);
+    ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS cancelled BOOLEAN NOT NULL DEFAULT false;
+    ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS parent_id VARCHAR(36);
+    ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS client_message_id VARCHAR(100);
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_chat_messages_client_id
+        ON chat_messages (user_id, client_message_id) WHERE client_message_id IS NOT NULL;
+    CREATE TABLE IF NOT EXISTS message_feedback (
+        id VARCHAR(36) PRIMARY KEY,
+        message_id VARCHAR(36) NOT NULL,
+        user_id VARCHAR(255) NOT NULL,
+        rating VARCHAR(10) NOT NULL,
+        reason TEXT,
+        category VARCHAR(50),
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE (message_id, user_id),
+        FOREIGN KEY (message_id) REFERENCES chat_messages(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS idx_message_feedback_created ON message_feedback (created_at);
+
+    ALTER TABLE chat_messages ADD COLUMN IF NOT EXISTS seq BIGINT;
+    CREATE INDEX IF NOT EXISTS idx_chat_messages_conversation_seq
+        ON chat_messages (document_id, user_id, seq) WHERE seq IS NOT NULL;
+
+    CREATE TABLE IF NOT EXISTS hub_events (
+        id VARCHAR(36) PRIMARY KEY,
+        payload JSONB NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS idx_hub_events_created ON hub_events (created_at);
+
+    CREATE TABLE IF NOT EXISTS conversation_sequences (
+        conversation VARCHAR(300) PRIMARY KEY,
+        last BIGINT NOT NULL,
+        updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+    );
+
+    CREATE TABLE IF NOT EXISTS document_shares (
+        document_id VARCHAR(36) NOT NULL,
+        user_id VARCHAR(255) NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (document_id, user_id),
+        FOREIGN KEY (document_id) REFERENCES documents(id) ON DELETE CASCADE,
+        FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+    );
+    CREATE INDEX IF NOT EXISTS idx_document_shares_user ON document_shares (user_id);
+    `
+
+	_, err = db.Exec(migrationsSQL)
+	if err != nil {
+		log.Fatalf("Failed to migrate database schema: %v", err)
+	}
+
+	pgvectorEnabled = initVectorSchema(db)
+
 	log.Println("Database schema initialized successfully")
 }
+
+// initVectorSchema adds a pgvector column and index to document_chunks when the
+// vector extension is available. It returns false if the server doesn't have
+// the extension, in which case embeddings stay in the BYTEA column and
+// similarity is computed in-process.
+func initVectorSchema(db *sql.DB) bool {
+	if _, err := db.Exec("CREATE EXTENSION IF NOT EXISTS vector"); err != nil {
+		log.Printf("pgvector extension not available, using in-process similarity search: %v", err)
+		return false
+	}
+
+	vectorSQL := fmt.Sprintf(`
+    ALTER TABLE document_chunks ADD COLUMN IF NOT EXISTS embedding_vector vector(%d);
+    CREATE INDEX IF NOT EXISTS idx_document_chunks_embedding_vector
+        ON document_chunks USING hnsw (embedding_vector vector_cosine_ops);
+    `, embeddingDimensions)
+
+	if _, err := db.Exec(vectorSQL); err != nil {
+		log.Printf("Failed to create pgvector column, using in-process similarity search: %v", err)
+		return false
+	}
+
+	log.Println("pgvector enabled for similarity search")
+	return true
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Default and maximum number of matching chunks per search page
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+)
+
+// ts_headline marks matches with these control characters rather than
+// <mark> tags, so the chunk text can be HTML-escaped before the tags go in
+const (
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+)
+
+// ts_headline options; passed as a parameter because of the control characters
+var headlineOptions = "StartSel=" + highlightStart + ", StopSel=" + highlightStop +
+	`, MaxWords=35, MinWords=15, MaxFragments=2, FragmentDelimiter=" … "`
+
+// Turn a ts_headline fragment into HTML: the chunk text is escaped and only
+// the highlighted matches are wrapped in <mark> tags
+func highlightSnippet(headline string) string {
+	escaped := html.EscapeString(headline)
+	escaped = strings.ReplaceAll(escaped, highlightStart, "<mark>")
+	return strings.ReplaceAll(escaped, highlightStop, "</mark>")
+}
+
+// A chunk matching a search query
+type SearchMatch struct {
+	ChunkID    string  `json:"chunk_id"`
+	ChunkIndex int     `json:"chunk_index"`
+	PageNumber int     `json:"page_number,omitempty"`
+	Snippet    string  `json:"snippet"` // Escaped HTML, matches wrapped in <mark>
+	Score      float64 `json:"score"`
+}
+
+// Search matches grouped under their document
+type SearchDocumentResult struct {
+	DocumentID string        `json:"document_id"`
+	FileName   string        `json:"file_name"`
+	Collection string        `json:"collection,omitempty"`
+	UploadedAt time.Time     `json:"uploaded_at"`
+	Matches    []SearchMatch `json:"matches"`
+}
+
+type SearchResponse struct {
+	Success   bool                   `json:"success"`
+	Query     string                 `json:"query"`
+	Page      int                    `json:"page"`
+	PageSize  int                    `json:"page_size"`
+	Total     int                    `json:"total"`
+	Documents []SearchDocumentResult `json:"documents"`
+}
+
+// Parse a date filter given either as YYYY-MM-DD or RFC 3339
+func parseSearchDate(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Full-text search across a user's documents.
+//
+// Query parameters: q (required; supports "quoted phrases", OR and -exclusion),
+// userId (required), collection, fileType (pdf or txt), from and to (upload
+// date range), page and pageSize. Matches are paginated by chunk and grouped
+// by document in rank order.
+func searchDocumentsHandler(c *gin.Context) {
+	query := strings.TrimSpace(c.Query("q"))
+	userID := c.Query("userId")
+
+	if query == "" || userID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "q and userId query parameters are required",
+		})
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", strconv.Itoa(defaultSearchPageSize)))
+	if err != nil || pageSize < 1 {
+		pageSize = defaultSearchPageSize
+	}
+	if pageSize > maxSearchPageSize {
+		pageSize = maxSearchPageSize
+	}
+
+	fileType := strings.TrimPrefix(strings.ToLower(c.Query("fileType")), ".")
+	if fileType != "" && fileType != "pdf" && fileType != "txt" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "fileType must be pdf or txt",
+		})
+		return
+	}
+
+	var from, to *time.Time
+	if value := c.Query("from"); value != "" {
+		t, err := parseSearchDate(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Success: false,
+				Error:   "Invalid from date: " + err.Error(),
+			})
+			return
+		}
+		from = &t
+	}
+	if value := c.Query("to"); value != "" {
+		t, err := parseSearchDate(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Success: false,
+				Error:   "Invalid to date: " + err.Error(),
+			})
+			return
+		}
+		// A bare date includes the whole day
+		if len(value) == len("2006-01-02") {
+			t = t.Add(24 * time.Hour)
+		}
+		to = &t
+	}
+
+	rows, err := db.QueryContext(c.Request.Context(), `
+		WITH q AS (SELECT websearch_to_tsquery('english', $1) AS query)
+		SELECT d.id, d.file_name, COALESCE(d.collection, ''), d.uploaded_at,
+			c.id, c.chunk_index, COALESCE(c.page_number, 0),
+			ts_headline('english', replace(replace(c.content, chr(2), ''), chr(3), ''), q.query, $9),
+			ts_rank_cd(c.content_tsv, q.query, 1) AS score,
+			COUNT(*) OVER () AS total
+		FROM document_chunks c
+		JOIN documents d ON d.id = c.document_id, q
+		WHERE d.user_id = $2
+			AND c.content_tsv @@ q.query
+			AND ($3 = '' OR d.collection = $3)
+			AND ($4 = '' OR lower(d.file_name) LIKE '%.' || $4)
+			AND ($5::timestamptz IS NULL OR d.uploaded_at >= $5)
+			AND ($6::timestamptz IS NULL OR d.uploaded_at < $6)
+		ORDER BY score DESC, d.uploaded_at DESC, c.chunk_index
+		LIMIT $7 OFFSET $8`,
+		query, userID, c.Query("collection"), fileType, from, to, pageSize, (page-1)*pageSize, headlineOptions)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to search documents: " + err.Error(),
+		})
+		return
+	}
+	defer rows.Close()
+
+	total := 0
+	documents := []SearchDocumentResult{}
+	documentIndex := make(map[string]int)
+
+	for rows.Next() {
+		var doc SearchDocumentResult
+		var match SearchMatch
+		err := rows.Scan(&doc.DocumentID, &doc.FileName, &doc.Collection, &doc.UploadedAt,
+			&match.ChunkID, &match.ChunkIndex, &match.PageNumber, &match.Snippet, &match.Score, &total)
+		if err != nil {
+			log.Printf("Error scanning search result: %v", err)
+			continue
+		}
+		match.Snippet = highlightSnippet(match.Snippet)
+
+		i, ok := documentIndex[doc.DocumentID]
+		if !ok {
+			i = len(documents)
+			documentIndex[doc.DocumentID] = i
+			documents = append(documents, doc)
+		}
+		documents[i].Matches = append(documents[i].Matches, match)
+	}
+
+	c.JSON(http.StatusOK, SearchResponse{
+		Success:   true,
+		Query:     query,
+		Page:      page,
+		PageSize:  pageSize,
+		Total:     total,
+		Documents: documents,
+	})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DocumentShare gives a user access to another user's document. Users a
+// document is shared with can chat about it and join its room.
+type DocumentShare struct {
+	DocumentID string    `json:"document_id"`
+	UserID     string    `json:"user_id"`
+	Email      string    `json:"email,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type ShareRequest struct {
+	OwnerID string `json:"owner_id" binding:"required"`
+	UserID  string `json:"user_id" binding:"required"`
+}
+
+// Whether a user owns a document or has had it shared with them
+func canAccessDocument(ctx context.Context, documentID, userID string) (bool, error) {
+	var hasAccess bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS(SELECT 1 FROM documents WHERE id = $1 AND user_id = $2)
+			OR EXISTS(SELECT 1 FROM document_shares WHERE document_id = $1 AND user_id = $2)`,
+		documentID, userID).Scan(&hasAccess)
+	return hasAccess, err
+}
+
+// Check that ownerID owns the document, writing the error response if not
+func verifyDocumentOwner(c *gin.Context, documentID, ownerID string) bool {
+	var isOwner bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM documents WHERE id = $1 AND user_id = $2)",
+		documentID, ownerID).Scan(&isOwner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to verify document: " + err.Error(),
+		})
+		return false
+	}
+
+	if !isOwner {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Success: false,
+			Error:   "Document not found",
+		})
+		return false
+	}
+	return true
+}
+
+// Share a document with another user. Only the owner can share it.
+func shareDocumentHandler(c *gin.Context) {
+	documentID := c.Param("documentId")
+
+	var req ShareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	if req.UserID == req.OwnerID {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "A document can't be shared with its owner",
+		})
+		return
+	}
+
+	if !verifyDocumentOwner(c, documentID, req.OwnerID) {
+		return
+	}
+
+	share := DocumentShare{DocumentID: documentID, UserID: req.UserID}
+	err := db.QueryRow("SELECT email FROM users WHERE id = $1", req.UserID).Scan(&share.Email)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Success: false,
+			Error:   "User not found",
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to fetch user: " + err.Error(),
+		})
+		return
+	}
+
+	// Sharing again keeps the original share
+	err = db.QueryRow(`
+		INSERT INTO document_shares (document_id, user_id, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (document_id, user_id) DO UPDATE SET document_id = EXCLUDED.document_id
+		RETURNING created_at`,
+		documentID, req.UserID, time.Now()).Scan(&share.CreatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to share document: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"share":   share,
+	})
+}
+
+// List the users a document is shared with. Only the owner can list them.
+func listSharesHandler(c *gin.Context) {
+	documentID := c.Param("documentId")
+	ownerID := c.Query("ownerId")
+
+	if ownerID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "ownerId is required",
+		})
+		return
+	}
+
+	if !verifyDocumentOwner(c, documentID, ownerID) {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT s.user_id, u.email, s.created_at
+		FROM document_shares s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.document_id = $1
+		ORDER BY s.created_at`, documentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to fetch shares: " + err.Error(),
+		})
+		return
+	}
+	defer rows.Close()
+
+	shares := []DocumentShare{}
+	for rows.Next() {
+		share := DocumentShare{DocumentID: documentID}
+		if err := rows.Scan(&share.UserID, &share.Email, &share.CreatedAt); err != nil {
+			log.Printf("Error scanning share: %v", err)
+			continue
+		}
+		shares = append(shares, share)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"shares":  shares,
+	})
+}
+
+// Stop sharing a document with a user. The owner can remove anyone; a user
+// can remove themselves. The user's open connections to the document are
+// closed, on every instance.
+func unshareDocumentHandler(c *gin.Context) {
+	documentID := c.Param("documentId")
+	userID := c.Param("userId")
+	requesterID := c.Query("requesterId")
+
+	if requesterID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "requesterId is required",
+		})
+		return
+	}
+
+	if requesterID != userID && !verifyDocumentOwner(c, documentID, requesterID) {
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM document_shares WHERE document_id = $1 AND user_id = $2", documentID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to remove share: " + err.Error(),
+		})
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Success: false,
+			Error:   "Share not found",
+		})
+		return
+	}
+
+	hub.evictUser(documentID, userID)
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Set once shutdown starts; new connections and queries are refused
+var draining atomic.Bool
+
+// WebSocket queries that haven't finished yet
+var inflightQueries sync.WaitGroup
+
+// Stop the server gracefully: refuse new work, close WebSockets with a
+// "server restarting" frame, and wait for in-flight requests, queries and
+// background jobs until ctx expires. Returns false if anything was cut off.
+func shutdown(ctx context.Context, srv *http.Server) bool {
+	draining.Store(true)
+	clean := true
+
+	// Clients reconnect elsewhere and replay what they missed; queries still
+	// running save their answers for the replay
+	hub.closeAll()
+
+	// Closes the listener and waits for requests such as uploads
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down HTTP server: %v", err)
+		clean = false
+	}
+
+	if err := waitGroupContext(ctx, &inflightQueries); err != nil {
+		log.Printf("Gave up waiting for WebSocket queries: %v", err)
+		clean = false
+	}
+
+	// Uploads have finished, so no more jobs can be queued. Jobs still queued
+	// when ctx expires are abandoned; their batches are released to the next
+	// instance.
+	if err := worker.Stop(ctx); err != nil {
+		log.Printf("Gave up waiting for background jobs: %v", err)
+		clean = false
+	}
+
+	return clean
+}
+
+// Wait for a WaitGroup, giving up when ctx expires
+func waitGroupContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
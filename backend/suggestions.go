@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Number of questions suggested per document
+const suggestionCount = 5
+
+// Maximum tokens of document text shown to the model when suggesting questions
+const suggestionContextTokens = 6000
+
+type DocumentSuggestions struct {
+	DocumentID  string    `json:"document_id"`
+	Version     string    `json:"version,omitempty"`
+	Suggestions []string  `json:"suggestions"`
+	CreatedAt   time.Time `json:"created_at,omitempty"`
+}
+
+// Pick chunks spread evenly over the document so that they fit in budget,
+// so generated questions cover more than the opening pages
+func sampleChunks(t Tokenizer, chunks []RetrievedChunk, budget int) []RetrievedChunk {
+	total := 0
+	for _, chunk := range chunks {
+		total += t.CountTokens(chunk.Content)
+	}
+
+	stride := 1
+	if total > budget {
+		stride = (total + budget - 1) / budget
+	}
+
+	var sampled []RetrievedChunk
+	remaining := budget
+	for i := 0; i < len(chunks); i += stride {
+		tokens := t.CountTokens(chunks[i].Content)
+		if tokens > remaining {
+			break
+		}
+		sampled = append(sampled, chunks[i])
+		remaining -= tokens
+	}
+	return sampled
+}
+
+// Ask the model for questions a new reader could ask about the document
+func suggestQuestions(ctx context.Context, chunks []RetrievedChunk) ([]string, error) {
+	var texts []string
+	for _, chunk := range sampleChunks(estimator, chunks, suggestionContextTokens) {
+		texts = append(texts, chunk.Content)
+	}
+	content := strings.Join(texts, "\n\n")
+
+	prompt := fmt.Sprintf(`Suggest %d questions that someone reading the document below for the first time would find useful to ask. Each question must be answerable from the document, specific to its content, and no longer than one sentence. Cover different parts of the document.
+
+Return a JSON array of strings.
+
+Document:
+%s`, suggestionCount, content)
+
+	output, err := provider.GenerateJSON(ctx, prompt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get response from AI: %v", err)
+	}
+
+	var questions []string
+	if err := json.Unmarshal([]byte(stripCodeFence(output)), &questions); err != nil {
+		return nil, fmt.Errorf("failed to parse suggestions: %v", err)
+	}
+
+	suggestions := make([]string, 0, suggestionCount)
+	for _, question := range questions {
+		question = strings.TrimSpace(question)
+		if question != "" && len(suggestions) < suggestionCount {
+			suggestions = append(suggestions, question)
+		}
+	}
+	if len(suggestions) == 0 {
+		return nil, fmt.Errorf("model returned no suggestions")
+	}
+	return suggestions, nil
+}
+
+// Generate and store suggested questions for a document, replacing any
+// previous set, and push them to the document's WebSocket clients
+func generateSuggestions(ctx context.Context, documentID string) (*DocumentSuggestions, error) {
+	chunks, err := getOrderedChunks(ctx, documentID)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, fmt.Errorf("no content found for this document")
+	}
+
+	questions, err := suggestQuestions(ctx, chunks)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DocumentSuggestions{
+		DocumentID:  documentID,
+		Version:     documentVersion(chunks),
+		Suggestions: questions,
+		CreatedAt:   time.Now(),
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM document_suggestions WHERE document_id = $1", documentID); err != nil {
+		return nil, fmt.Errorf("failed to clear suggestions: %v", err)
+	}
+	for i, question := range questions {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO document_suggestions (id, document_id, position, question, version, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			uuid.New().String(), documentID, i, question, result.Version, result.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save suggestion: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to save suggestions: %v", err)
+	}
+
+	hub.broadcastToDocument(documentID, WSResponse{
+		Type:        wsSuggestions,
+		ID:          uuid.New().String(),
+		Timestamp:   time.Now().Format(time.RFC3339),
+		Suggestions: questions,
+	})
+
+	return result, nil
+}
+
+// Generate suggestions after ingestion. Runs on the background worker.
+func autoSuggest(ctx context.Context, documentID string) {
+	if _, err := generateSuggestions(ctx, documentID); err != nil {
+		log.Printf("Error suggesting questions for document %s: %v", documentID, err)
+		return
+	}
+	log.Printf("Suggested questions for document %s", documentID)
+}
+
+// Fetch the stored suggestions of a document
+func getSuggestions(ctx context.Context, documentID string) (*DocumentSuggestions, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT question, version, created_at FROM document_suggestions
+		WHERE document_id = $1 ORDER BY position`, documentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch suggestions: %v", err)
+	}
+	defer rows.Close()
+
+	result := &DocumentSuggestions{DocumentID: documentID, Suggestions: []string{}}
+	for rows.Next() {
+		var question string
+		if err := rows.Scan(&question, &result.Version, &result.CreatedAt); err != nil {
+			log.Printf("Error scanning suggestion: %v", err)
+			continue
+		}
+		result.Suggestions = append(result.Suggestions, question)
+	}
+
+	return result, rows.Err()
+}
+
+// Get suggested questions for a document. The list is empty until
+// generation after ingestion has finished.
+func getSuggestionsHandler(c *gin.Context) {
+	documentID := c.Param("documentId")
+	var documentExists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM documents WHERE id = $1)", documentID).Scan(&documentExists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to verify document: " + err.Error(),
+		})
+		return
+	}
+
+	if !documentExists {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Success: false,
+			Error:   "Document not found",
+		})
+		return
+	}
+
+	suggestions, err := getSuggestions(c.Request.Context(), documentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":     true,
+		"suggestions": suggestions,
+	})
+}
+
+// Regenerate suggested questions for a document
+func regenerateSuggestionsHandler(c *gin.Context) {
+	documentID := c.Param("documentId")
+	var documentExists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM documents WHERE id = $1)", documentID).Scan(&documentExists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to verify document: " + err.Error(),
+		})
+		return
+	}
+
+	if !documentExists {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Success: false,
+			Error:   "Document not found",
+		})
+		return
+	}
+
+	suggestions, err := generateSuggestions(c.Request.Context(), documentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to suggest questions: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":     true,
+		"suggestions": suggestions,
+	})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Maximum tokens of document text (or partial summaries) summarised per LLM call
+const summaryGroupTokens = 6000
+
+// Reduce rounds before the remaining partial summaries are forced into one call
+const maxReduceRounds = 4
+
+// Summary styles
+const (
+	summaryBullet    = "bullet"
+	summaryExecutive = "executive"
+	summarySections  = "sections"
+)
+
+// Target length of each summary length option
+var summaryLengths = map[string]string{
+	"short":  "about 100 words",
+	"medium": "about 250 words",
+	"long":   "about 600 words",
+}
+
+// Instructions for each summary style
+var summaryStyles = map[string]string{
+	summaryBullet:    "Write the summary as a bulleted list of the key points, one point per bullet.",
+	summaryExecutive: "Write an executive summary in prose for a busy decision maker: the purpose, the main findings or terms, and any actions, risks or deadlines.",
+	summarySections:  "Summarise section by section, keeping the document's own section headings in order with a short summary under each.",
+}
+
+type SummaryRequest struct {
+	Style   string `json:"style,omitempty"`
+	Length  string `json:"length,omitempty"`
+	Refresh bool   `json:"refresh,omitempty"`
+}
+
+type DocumentSummary struct {
+	DocumentID string    `json:"document_id"`
+	Version    string    `json:"version"`
+	Style      string    `json:"style"`
+	Length     string    `json:"length"`
+	Summary    string    `json:"summary"`
+	Cached     bool      `json:"cached"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Fill in default summary options and validate them
+func normalizeSummaryRequest(req *SummaryRequest) error {
+	if req.Style == "" {
+		req.Style = summaryBullet
+	}
+	if req.Length == "" {
+		req.Length = "medium"
+	}
+	if _, ok := summaryStyles[req.Style]; !ok {
+		return fmt.Errorf("style must be one of bullet, executive or sections")
+	}
+	if _, ok := summaryLengths[req.Length]; !ok {
+		return fmt.Errorf("length must be one of short, medium or long")
+	}
+	return nil
+}
+
+// Version of a document's content: a hash over its chunks, so re-ingesting
+// changed content invalidates cached results
+func documentVersion(chunks []RetrievedChunk) string {
+	h := sha256.New()
+	for _, chunk := range chunks {
+		h.Write([]byte(chunk.Content))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// Group texts in order so that each group fits in maxTokens. A single text
+// larger than the limit is truncated rather than split across groups.
+func groupByTokens(t Tokenizer, texts []string, maxTokens int) [][]string {
+	var groups [][]string
+	var current []string
+	currentTokens := 0
+
+	for _, text := range texts {
+		tokens := t.CountTokens(text)
+		if tokens > maxTokens {
+			text = truncateToTokens(t, text, maxTokens)
+			tokens = t.CountTokens(text)
+		}
+		if currentTokens+tokens > maxTokens && len(current) > 0 {
+			groups = append(groups, current)
+			current = nil
+			currentTokens = 0
+		}
+		current = append(current, text)
+		currentTokens += tokens
+	}
+	if len(current) > 0 {
+		groups = append(groups, current)
+	}
+
+	return groups
+}
+
+// Summarise one part of a document (map step)
+func summarizePart(ctx context.Context, part string, index, total int, style string) (string, error) {
+	prompt := fmt.Sprintf(`You are summarising part %d of %d of a longer document. Summarise this part faithfully, keeping names, numbers, dates and defined terms exactly as written. Do not add information that is not in the text.
+%s
+
+Text:
+%s`, index+1, total, summaryStyles[style], part)
+
+	return provider.Generate(ctx, prompt)
+}
+
+// Combine partial summaries into one (reduce step)
+func combineSummaries(ctx context.Context, partials []string, style, length string, final bool) (string, error) {
+	target := "Keep it concise enough to be combined again with other summaries."
+	if final {
+		target = "The final summary should be " + summaryLengths[length] + "."
+	}
+
+	prompt := fmt.Sprintf(`The following are summaries of consecutive parts of one document. Combine them into a single coherent summary of the whole document, removing repetition and keeping the original order. Keep names, numbers, dates and defined terms exactly as written.
+%s
+%s
+
+Partial summaries:
+%s`, summaryStyles[style], target, strings.Join(partials, "\n\n---\n\n"))
+
+	return provider.Generate(ctx, prompt)
+}
+
+// Map-reduce summarisation over a document's chunks. Partial summaries are
+// reduced in groups until a single summary remains.
+func summarizeChunks(ctx context.Context, chunks []RetrievedChunk, style, length string) (string, error) {
+	texts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		texts[i] = chunk.Content
+	}
+
+	groups := groupByTokens(estimator, texts, summaryGroupTokens)
+	if len(groups) == 1 {
+		return combineSummaries(ctx, []string{strings.Join(groups[0], "\n\n")}, style, length, true)
+	}
+
+	partials := make([]string, 0, len(groups))
+	for i, group := range groups {
+		partial, err := summarizePart(ctx, strings.Join(group, "\n\n"), i, len(groups), style)
+		if err != nil {
+			return "", fmt.Errorf("failed to summarise part %d: %v", i+1, err)
+		}
+		partials = append(partials, partial)
+	}
+
+	for round := 0; ; round++ {
+		groups = groupByTokens(estimator, partials, summaryGroupTokens)
+		if len(groups) == 1 {
+			return combineSummaries(ctx, groups[0], style, length, true)
+		}
+
+		// Partial summaries that stop shrinking are cut down to share one call
+		if round == maxReduceRounds {
+			share := summaryGroupTokens / len(partials)
+			for i := range partials {
+				partials[i] = truncateToTokens(estimator, partials[i], share)
+			}
+			return combineSummaries(ctx, partials, style, length, true)
+		}
+
+		partials = partials[:0]
+		for _, group := range groups {
+			partial, err := combineSummaries(ctx, group, style, length, false)
+			if err != nil {
+				return "", err
+			}
+			partials = append(partials, partial)
+		}
+	}
+}
+
+// Fetch a cached summary for a document version
+func getCachedSummary(ctx context.Context, documentID, version, style, length string) (*DocumentSummary, error) {
+	summary := &DocumentSummary{DocumentID: documentID, Version: version, Style: style, Length: length, Cached: true}
+	err := db.QueryRowContext(ctx, `
+		SELECT summary, created_at FROM document_summaries
+		WHERE document_id = $1 AND version = $2 AND style = $3 AND length = $4`,
+		documentID, version, style, length).Scan(&summary.Summary, &summary.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to fetch cached summary: %v", err)
+	}
+	return summary, nil
+}
+
+// Summarise a document, using the cache unless refresh is set
+func generateSummary(ctx context.Context, documentID string, req SummaryRequest) (*DocumentSummary, error) {
+	chunks, err := getOrderedChunks(ctx, documentID)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, fmt.Errorf("no content found for this document")
+	}
+
+	version := documentVersion(chunks)
+	if !req.Refresh {
+		cached, err := getCachedSummary(ctx, documentID, version, req.Style, req.Length)
+		if err != nil {
+			log.Printf("Error reading summary cache: %v", err)
+		} else if cached != nil {
+			return cached, nil
+		}
+	}
+
+	text, err := summarizeChunks(ctx, chunks, req.Style, req.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &DocumentSummary{
+		DocumentID: documentID,
+		Version:    version,
+		Style:      req.Style,
+		Length:     req.Length,
+		Summary:    text,
+		CreatedAt:  time.Now(),
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO document_summaries (id, document_id, version, style, length, summary, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (document_id, version, style, length)
+		DO UPDATE SET summary = EXCLUDED.summary, created_at = EXCLUDED.created_at`,
+		uuid.New().String(), documentID, version, req.Style, req.Length, text, summary.CreatedAt)
+	if err != nil {
+		log.Printf("Error caching summary: %v", err)
+	}
+
+	return summary, nil
+}
+
+// Summarise a document after ingestion when AUTO_SUMMARIZE is enabled. Runs
+// on the background worker.
+func autoSummarize(ctx context.Context, documentID string) {
+	req := SummaryRequest{}
+	normalizeSummaryRequest(&req)
+
+	if _, err := generateSummary(ctx, documentID, req); err != nil {
+		log.Printf("Error summarising document %s: %v", documentID, err)
+		return
+	}
+	log.Printf("Summarised document %s", documentID)
+}
+
+// Summary endpoint
+func summaryHandler(c *gin.Context) {
+	documentID := c.Param("documentId")
+
+	var req SummaryRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Success: false,
+				Error:   "Invalid request body: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	if err := normalizeSummaryRequest(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	var documentExists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM documents WHERE id = $1)", documentID).Scan(&documentExists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to verify document: " + err.Error(),
+		})
+		return
+	}
+
+	if !documentExists {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Success: false,
+			Error:   "Document not found",
+		})
+		return
+	}
+
+	summary, err := generateSummary(c.Request.Context(), documentID, req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to summarise document: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"summary": summary,
+	})
+}
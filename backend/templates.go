@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Built-in prompt templates, one file per preset
+//
+//go:embed prompts/*.tmpl
+var embeddedPrompts embed.FS
+
+// Name of the template used when neither the request nor the document picks one
+const defaultPromptTemplate = "default"
+
+// Loaded prompt templates, keyed by name (file name without .tmpl)
+var promptTemplates map[string]*template.Template
+
+// PromptData holds the variables available to prompt templates
+type PromptData struct {
+	Context  string
+	History  string
+	Question string
+	Settings map[string]string
+}
+
+// Load the embedded prompt templates, then any *.tmpl files in dir, which
+// replace embedded templates of the same name
+func loadPromptTemplates(dir string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template)
+
+	entries, err := embeddedPrompts.ReadDir("prompts")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embedded prompts: %v", err)
+	}
+	for _, entry := range entries {
+		text, err := embeddedPrompts.ReadFile("prompts/" + entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read prompt %s: %v", entry.Name(), err)
+		}
+		name := strings.TrimSuffix(entry.Name(), ".tmpl")
+		if templates[name], err = parsePromptTemplate(name, string(text)); err != nil {
+			return nil, err
+		}
+	}
+
+	if dir == "" {
+		return templates, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list prompt templates in %s: %v", dir, err)
+	}
+	for _, file := range files {
+		text, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read prompt template %s: %v", file, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(file), ".tmpl")
+		if templates[name], err = parsePromptTemplate(name, string(text)); err != nil {
+			return nil, err
+		}
+		log.Printf("Loaded prompt template %q from %s", name, file)
+	}
+
+	return templates, nil
+}
+
+// Parse a single prompt template
+func parsePromptTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse prompt template %s: %v", name, err)
+	}
+	return tmpl, nil
+}
+
+// Render a named prompt template
+func renderPromptTemplate(name string, data PromptData) (string, error) {
+	tmpl, ok := promptTemplates[name]
+	if !ok {
+		return "", fmt.Errorf("unknown prompt template %q", name)
+	}
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("failed to render prompt template %s: %v", name, err)
+	}
+	return out.String(), nil
+}
+
+// Pick the template for a query: the request's choice, then the document's,
+// then the default
+func resolvePromptTemplate(ctx context.Context, documentID, requested string) (string, error) {
+	if requested != "" {
+		if _, ok := promptTemplates[requested]; !ok {
+			return "", fmt.Errorf("unknown prompt template %q", requested)
+		}
+		return requested, nil
+	}
+
+	var documentTemplate sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT prompt_template FROM documents WHERE id = $1", documentID).Scan(&documentTemplate)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("failed to fetch document template: %v", err)
+	}
+
+	if documentTemplate.Valid {
+		if _, ok := promptTemplates[documentTemplate.String]; ok {
+			return documentTemplate.String, nil
+		}
+		log.Printf("Document %s uses unknown prompt template %q, using default", documentID, documentTemplate.String)
+	}
+
+	return defaultPromptTemplate, nil
+}
+
+// List available prompt templates
+func listPromptTemplates(c *gin.Context) {
+	names := make([]string, 0, len(promptTemplates))
+	for name := range promptTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"templates": names,
+		"default":   defaultPromptTemplate,
+	})
+}
+
+type SetTemplateRequest struct {
+	Template string `json:"template"`
+}
+
+// Set the prompt template used for a document's queries. An empty template
+// resets the document to the default.
+func setDocumentTemplate(c *gin.Context) {
+	documentID := c.Param("documentId")
+
+	var req SetTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   "Invalid request body: " + err.Error(),
+		})
+		return
+	}
+
+	if _, ok := promptTemplates[req.Template]; req.Template != "" && !ok {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Unknown prompt template %q", req.Template),
+		})
+		return
+	}
+
+	result, err := db.Exec("UPDATE documents SET prompt_template = NULLIF($1, '') WHERE id = $2", req.Template, documentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Success: false,
+			Error:   "Failed to update document: " + err.Error(),
+		})
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Success: false,
+			Error:   "Document not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
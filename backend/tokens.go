@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Tokenizer counts tokens the way the model will
+type Tokenizer interface {
+	CountTokens(text string) int
+}
+
+// Configured tokenizer. It may make a network call per count, so it is
+// used to check finished prompts rather than while packing them.
+var tokenizer Tokenizer = EstimatingTokenizer{}
+
+// Tokenizer used while packing prompts, where the same texts are counted
+// many times over. The estimate errs high, so packed prompts fit the budget.
+var estimator Tokenizer = EstimatingTokenizer{}
+
+// Create the tokenizer selected by name: "gemini" uses the provider's
+// countTokens API, anything else the local estimator
+func newTokenizer(name string) Tokenizer {
+	switch strings.ToLower(name) {
+	case "", "estimate":
+		return EstimatingTokenizer{}
+	case "gemini":
+		return newGeminiTokenizer(cfg.LLMModel)
+	default:
+		log.Printf("Unknown tokenizer %q, using estimator", name)
+		return EstimatingTokenizer{}
+	}
+}
+
+// EstimatingTokenizer approximates SentencePiece token counts without a
+// network call. It is calibrated per script: English and other Latin text
+// averages about four characters per token, CJK about one token per
+// character, and other scripts (Cyrillic, Devanagari, Arabic, ...) about two
+// characters per token. It errs on the high side so budgets aren't exceeded.
+type EstimatingTokenizer struct{}
+
+func (EstimatingTokenizer) CountTokens(text string) int {
+	var tokens float64
+	for _, r := range text {
+		switch {
+		case r < utf8.RuneSelf:
+			tokens += 0.25
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			tokens += 1
+		default:
+			tokens += 0.5
+		}
+	}
+	return int(math.Ceil(tokens))
+}
+
+// Most token counts kept by GeminiTokenizer
+const tokenCountCacheSize = 1024
+
+// GeminiTokenizer counts tokens with the Gemini countTokens API, falling back
+// to another tokenizer when the call fails. Counts are cached by text hash,
+// so the same prompt or chunk is only sent once.
+type GeminiTokenizer struct {
+	Model    string
+	Fallback Tokenizer
+
+	mu     sync.Mutex
+	counts map[[sha256.Size]byte]int
+	order  [][sha256.Size]byte
+}
+
+// Create a Gemini tokenizer for a model, using the estimator as fallback
+func newGeminiTokenizer(model string) *GeminiTokenizer {
+	return &GeminiTokenizer{
+		Model:    model,
+		Fallback: EstimatingTokenizer{},
+		counts:   make(map[[sha256.Size]byte]int),
+	}
+}
+
+func (t *GeminiTokenizer) CountTokens(text string) int {
+	key := sha256.Sum256([]byte(text))
+	t.mu.Lock()
+	count, ok := t.counts[key]
+	t.mu.Unlock()
+	if ok {
+		return count
+	}
+
+	count, err := callGeminiCountTokensAPI(t.Model, text)
+	if err != nil {
+		log.Printf("Error counting tokens, using estimate: %v", err)
+		return t.Fallback.CountTokens(text)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.counts[key]; !ok {
+		// Evict the oldest count once the cache is full
+		if len(t.order) == tokenCountCacheSize {
+			delete(t.counts, t.order[0])
+			t.order = t.order[1:]
+		}
+		t.counts[key] = count
+		t.order = append(t.order, key)
+	}
+	return count
+}
+
+// Call the Gemini countTokens API
+func callGeminiCountTokensAPI(model, text string) (int, error) {
+	jsonBody, err := json.Marshal(map[string]interface{}{
+		"contents": []map[string]interface{}{
+			{"parts": []map[string]interface{}{{"text": text}}},
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	url := "https://generativelanguage.googleapis.com/v1beta/models/" + model + ":countTokens?key=" + cfg.APIKey
+
+	resp, err := geminiClient().Post(url, "application/json", strings.NewReader(string(jsonBody)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to call Gemini countTokens API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Gemini countTokens API returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var countResp struct {
+		TotalTokens int `json:"totalTokens"`
+	}
+	if err := json.Unmarshal(respBody, &countResp); err != nil {
+		return 0, fmt.Errorf("failed to parse response: %v", err)
+	}
+
+	return countResp.TotalTokens, nil
+}
+
+// ModelBudget describes how a model's context window is shared out
+type ModelBudget struct {
+	// Total tokens the model accepts
+	ContextWindow int
+	// Reserved for the model's answer
+	OutputTokens int
+	// Reserved for chat history included in the prompt
+	HistoryTokens int
+	// Upper bound on document context, to keep latency and cost down
+	MaxContextTokens int
+}
+
+// Token budgets per model
+var modelBudgets = map[string]ModelBudget{
+	"gemini-2.5-flash": {ContextWindow: 1048576, OutputTokens: 2048, HistoryTokens: 2000, MaxContextTokens: 8000},
+	"gemini-2.5-pro":   {ContextWindow: 1048576, OutputTokens: 2048, HistoryTokens: 2000, MaxContextTokens: 16000},
+	"gemini-2.0-flash": {ContextWindow: 1048576, OutputTokens: 2048, HistoryTokens: 2000, MaxContextTokens: 8000},
+}
+
+// Budget used for models not listed in modelBudgets
+var defaultModelBudget = ModelBudget{ContextWindow: 32768, OutputTokens: 2048, HistoryTokens: 2000, MaxContextTokens: 8000}
+
+// Look up the budget for a model, applying the configured context cap
+func budgetForModel(model string) ModelBudget {
+	budget, ok := modelBudgets[model]
+	if !ok {
+		budget = defaultModelBudget
+	}
+	if cfg.MaxContextTokens > 0 {
+		budget.MaxContextTokens = cfg.MaxContextTokens
+	}
+	return budget
+}
+
+// Tokens available for document context once the rest of the prompt,
+// history and output are accounted for
+func (b ModelBudget) contextTokens(overheadTokens int) int {
+	available := b.ContextWindow - b.OutputTokens - b.HistoryTokens - overheadTokens
+	if available > b.MaxContextTokens {
+		available = b.MaxContextTokens
+	}
+	if available < 0 {
+		return 0
+	}
+	return available
+}
+
+// Smallest remainder worth filling with a truncated chunk
+const minTruncatedChunkTokens = 64
+
+// Cut text to at most maxTokens, at a word boundary where possible. The
+// result is always valid UTF-8.
+func truncateToTokens(t Tokenizer, text string, maxTokens int) string {
+	if t.CountTokens(text) <= maxTokens {
+		return text
+	}
+
+	runes := []rune(text)
+	// Start from a proportional guess and shrink until it fits
+	n := len(runes) * maxTokens / t.CountTokens(text)
+	for n > 0 {
+		candidate := string(runes[:n])
+		if i := strings.LastIndexFunc(candidate, unicode.IsSpace); i > 0 {
+			candidate = candidate[:i]
+		}
+		candidate = strings.TrimSpace(candidate)
+		if t.CountTokens(candidate) <= maxTokens {
+			return candidate
+		}
+		n = n * 9 / 10
+	}
+
+	return ""
+}
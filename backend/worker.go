@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// Default number of background jobs run at once
+const defaultWorkerConcurrency = 4
+
+// Jobs waiting beyond this block the caller of Enqueue
+const workerQueueSize = 1024
+
+// Reason given to jobs abandoned because the server is shutting down
+const jobAbandonedReason = "interrupted by server shutdown"
+
+// Job is a unit of background work
+type Job struct {
+	Name string
+	Run  func(ctx context.Context)
+	// Called instead of Run when the job won't be run: it was queued after
+	// Stop, or was still queued when Stop gave up. Optional.
+	Abandon func(reason string)
+}
+
+// Worker runs background jobs (summaries, batch extraction, ...) on a fixed
+// pool of goroutines, outside the request that queued them
+type Worker struct {
+	jobs chan Job
+	wg   sync.WaitGroup
+
+	// Closed by Stop, waking callers of Enqueue blocked on a full queue
+	stop chan struct{}
+
+	// Set by Stop; guards against new sends once jobs is about to close.
+	// The lock is never held while waiting for room in the queue.
+	mu      sync.RWMutex
+	stopped bool
+	senders sync.WaitGroup
+	closed  sync.Once
+
+	// Set when Stop gives up; queued jobs are then abandoned, not run
+	halted atomic.Bool
+}
+
+// Create a worker. Call Start to run its jobs.
+func newWorker() *Worker {
+	return &Worker{
+		jobs: make(chan Job, workerQueueSize),
+		stop: make(chan struct{}),
+	}
+}
+
+// Global background worker, started in main
+var worker = newWorker()
+
+// Start the worker's goroutines. Jobs receive ctx, which should be
+// cancelled when the server shuts down.
+func (w *Worker) Start(ctx context.Context, concurrency int) {
+	if concurrency <= 0 {
+		concurrency = defaultWorkerConcurrency
+	}
+
+	for i := 0; i < concurrency; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for job := range w.jobs {
+				if w.halted.Load() {
+					abandonJob(job, jobAbandonedReason)
+					continue
+				}
+				w.run(ctx, job)
+			}
+		}()
+	}
+
+	log.Printf("Background worker started with %d goroutines", concurrency)
+}
+
+// Run one job, keeping a panicking job from taking down the worker
+func (w *Worker) run(ctx context.Context, job Job) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Background job %s panicked: %v", job.Name, r)
+		}
+	}()
+	job.Run(ctx)
+}
+
+// Give up on a job that won't be run
+func abandonJob(job Job, reason string) {
+	log.Printf("Abandoning background job %s: %s", job.Name, reason)
+	if job.Abandon == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Abandoning background job %s panicked: %v", job.Name, r)
+		}
+	}()
+	job.Abandon(reason)
+}
+
+// Queue a job, blocking while the queue is full
+func (w *Worker) Enqueue(name string, run func(ctx context.Context)) {
+	w.EnqueueJob(Job{Name: name, Run: run})
+}
+
+// Queue a job, blocking while the queue is full. A job queued after Stop,
+// or while Enqueue is waiting for room, is abandoned.
+func (w *Worker) EnqueueJob(job Job) {
+	w.mu.RLock()
+	stopped := w.stopped
+	if !stopped {
+		w.senders.Add(1)
+	}
+	w.mu.RUnlock()
+
+	if stopped {
+		abandonJob(job, jobAbandonedReason)
+		return
+	}
+	defer w.senders.Done()
+
+	select {
+	case w.jobs <- job:
+	case <-w.stop:
+		abandonJob(job, jobAbandonedReason)
+	}
+}
+
+// Queue jobs from a goroutine, so the caller doesn't wait for room in the
+// queue. Stop waits for the goroutine; jobs it hasn't queued by then are
+// abandoned.
+func (w *Worker) EnqueueAll(jobs []Job) {
+	w.mu.RLock()
+	stopped := w.stopped
+	if !stopped {
+		w.senders.Add(1)
+	}
+	w.mu.RUnlock()
+
+	if stopped {
+		for _, job := range jobs {
+			abandonJob(job, jobAbandonedReason)
+		}
+		return
+	}
+
+	go func() {
+		defer w.senders.Done()
+		for i, job := range jobs {
+			select {
+			case w.jobs <- job:
+			case <-w.stop:
+				for _, job := range jobs[i:] {
+					abandonJob(job, jobAbandonedReason)
+				}
+				return
+			}
+		}
+	}()
+}
+
+// Stop accepting jobs and wait for the queued ones to finish, giving up when
+// ctx expires. Jobs still queued then are abandoned; jobs still running are
+// left to their own context.
+func (w *Worker) Stop(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.stopped {
+		w.stopped = true
+		close(w.stop)
+	}
+	w.mu.Unlock()
+
+	// Callers of Enqueue return promptly once stop is closed, after which
+	// nothing else sends on jobs
+	w.senders.Wait()
+	w.closed.Do(func() { close(w.jobs) })
+
+	err := waitGroupContext(ctx, &w.wg)
+	if err != nil {
+		w.halted.Store(true)
+		for job := range w.jobs {
+			abandonJob(job, jobAbandonedReason)
+		}
+	}
+	return err
+}
@@ -193,24 +193,12 @@ export default function Chat() {
     setIsLoading(true);
 
     try {
-      // Save the message to the backend
-      await fetch(`${API_BASE_URL}/chat`, {
-        method: "POST",
-        headers: {
-          "Content-Type": "application/json",
-        },
-        body: JSON.stringify({
-          document_id: documentId,
-          user_id: "u1",
-          message_type: "user",
-          message_content: userMessage.content,
-        }),
-      });
-
-      // Send the message via WebSocket to get a response
+      // Send the message via WebSocket to get a response. The server saves
+      // the question together with the answer.
       ws.send(
         JSON.stringify({
           type: "query",
+          id: crypto.randomUUID(),
           content: userMessage.content,
           documentId: documentId,
           userId: "u1",